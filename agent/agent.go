@@ -2,10 +2,13 @@ package agent
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
 	"net/url"
 	"os"
 	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -16,66 +19,182 @@ type AgentOpts struct {
 	// HubAddr is the address of the hub server
 	HubAddr url.URL `arg:"--hub,required" help:"address of the hub server (e.g. ws://localhost:9090)"`
 
-	// InferenceAddr is the address of the inference server
-	InferenceAddr url.URL `arg:"--inference" help:"address of the OpenAI-compatible inference server" default:"http://localhost:5000"`
+	// HubToken is the shared secret used to register with the hub
+	HubToken string `arg:"--hub-token,env:HUB_TOKEN" help:"shared secret used to register with the hub"`
+
+	// Inference are the inference servers to forward requests to. If empty,
+	// a server on http://localhost:5000 is used.
+	Inference []InferenceBackend `arg:"--inference,separate" help:"address of an inference server, may be repeated, optionally followed by ;type=, ;auth= and ;models= options, e.g. http://localhost:5001;type=tgi;models=llama-*, http://localhost:5000 if unset"`
+
+	// BackendType is the API spoken by the inference servers, unless
+	// overridden for a server
+	BackendType string `arg:"--backend-type" help:"API of the inference servers: openai, llamacpp, tgi or ollama" default:"openai"`
 
 	// InferenceAuthorization is the value used for the Authorization header
-	// when querying the inference server
-	InferenceAuthorization string `arg:"--inference-authorization,env:INFERENCE_AUTHORIZATION" help:"value for the Authorization header when querying the inference server (e.g. Bearer abc)"`
+	// when querying the inference servers, unless overridden for a server
+	InferenceAuthorization string `arg:"--inference-authorization,env:INFERENCE_AUTHORIZATION" help:"value for the Authorization header when querying the inference servers (e.g. Bearer abc)"`
 
 	// WorkerName is the name of the worker
 	WorkerName string `arg:"--name" help:"name of the worker" default:"worker"`
+
+	// EmbeddingModels are the models of the inference server that can only
+	// serve embeddings requests
+	EmbeddingModels []string `arg:"--embedding-model,separate" help:"model that only serves embeddings requests, may be repeated"`
+
+	// MaxConcurrency is the number of requests the worker accepts at once. If
+	// zero, it is detected from the inference server.
+	MaxConcurrency int `arg:"--max-concurrency" help:"number of requests to process at once, 0 to detect from the inference server" default:"0"`
+
+	// RefreshInterval is how often to check the inference server for changes
+	// to its models. If zero, the models are only announced on registration.
+	RefreshInterval time.Duration `arg:"--refresh-interval" help:"how often to announce changes to the available models, 0 to disable" default:"1m"`
+
+	// DrainTimeout is how long to wait for requests in progress to complete
+	// after receiving SIGTERM, before disconnecting from the hub
+	DrainTimeout time.Duration `arg:"--drain-timeout" help:"how long to wait for requests in progress to complete on SIGTERM" default:"90s"`
+
+	// ReconnectMin is the initial delay before reconnecting to the hub
+	ReconnectMin time.Duration `arg:"--reconnect-min" help:"initial delay before reconnecting to the hub" default:"1s"`
+
+	// ReconnectMax is the maximum delay before reconnecting to the hub
+	ReconnectMax time.Duration `arg:"--reconnect-max" help:"maximum delay before reconnecting to the hub" default:"1m"`
 }
 
 func RunAgent(opts *AgentOpts, ctx context.Context) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
+	// SIGTERM drains the worker, anything else stops it right away
+	drain := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		draining := false
+		for {
+			select {
+			case sig := <-signals:
+				if sig == syscall.SIGTERM && !draining {
+					log.Println("SIGTERM received, draining")
+					draining = true
+					close(drain)
+					continue
+				}
+				log.Println("interrupt")
+				cancel()
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	be, err := newBackend(opts)
+	if err != nil {
+		return err
+	}
+	bo := newBackoff(opts.ReconnectMin, opts.ReconnectMax)
+	for {
+		registered, err := runSession(opts, be, drain, ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		select {
+		case <-drain:
+			return nil
+		default:
+		}
+
+		// Start over from the minimum delay if the last session got going
+		if registered {
+			bo.reset()
+		}
+
+		delay := bo.next()
+		if errors.Is(err, errHubShutdown) {
+			log.Printf("Hub is shutting down, reconnecting in %v", delay)
+		} else {
+			log.Printf("Disconnected from hub: %v, reconnecting in %v", err, delay)
+		}
+		select {
+		case <-time.After(delay):
+		case <-drain:
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
 
+// runSession connects to the hub, registers the worker and serves requests
+// until the connection is lost, the worker is drained or ctx is cancelled. It
+// reports whether the worker was successfully registered.
+func runSession(opts *AgentOpts, be backend, drain <-chan struct{}, ctx context.Context) (bool, error) {
 	log.Printf("Connecting to %s", opts.HubAddr.String())
 
 	fullAddr := opts.HubAddr.JoinPath("/internal/v1/worker/ws")
-	conn, _, err := websocket.DefaultDialer.Dial(fullAddr.String(), nil)
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, fullAddr.String(), nil)
 	if err != nil {
-		log.Fatal("dial:", err)
+		return false, fmt.Errorf("dial: %w", err)
 	}
 	defer conn.Close()
 
-	done := make(chan struct{})
-	conn.SetCloseHandler(func(code int, text string) error {
-		close(done)
-		return nil
-	})
-
 	mb := message.NewMessageBuffer(conn)
 	go mb.RecvLoop()
-	go initWebsocket(opts, done, mb, ctx)
 
-	for {
-		select {
-		case <-done:
-			return nil
-		case <-interrupt:
-			cancel()
-		case <-ctx.Done():
-			log.Println("interrupt")
+	// Stop the request handlers of this session once it ends
+	sessCtx, cancelSess := context.WithCancel(ctx)
+	defer cancelSess()
 
-			// Close the connection
-			err := mb.Close()
-			if err != nil {
-				log.Println("write close:", err)
-				return err
-			}
-
-			// Wait for the connection to close
-			select {
-			case <-done:
-			case <-time.After(time.Second):
-			}
+	info, err := initWebsocket(opts, mb, be, sessCtx)
+	if err != nil {
+		closeSession(mb)
+		return false, err
+	}
+	if opts.RefreshInterval > 0 {
+		go refreshWorkerInfo(opts, mb, be, info, sessCtx)
+	}
 
-			return nil
+	// End the session once drained
+	reqs := newInflight()
+	drained := make(chan struct{})
+	go func() {
+		select {
+		case <-drain:
+			drainSession(opts, mb, reqs, sessCtx)
+			close(drained)
+			cancelSess()
+		case <-sessCtx.Done():
 		}
+	}()
+
+	err = serveRequests(mb, be, reqs, sessCtx)
+	select {
+	case <-drained:
+		closeSession(mb)
+		return true, nil
+	default:
+	}
+	if ctx.Err() != nil {
+		closeSession(mb)
+		return true, nil
+	}
+	if errors.Is(err, errHubShutdown) {
+		closeSession(mb)
+	}
+	return true, err
+}
+
+// closeSession closes the connection to the hub and waits briefly for the hub
+// to acknowledge it.
+func closeSession(mb *message.MessageBuffer) {
+	if err := mb.Close(); err != nil {
+		log.Println("write close:", err)
+		return
+	}
+
+	select {
+	case <-mb.Done():
+	case <-time.After(time.Second):
 	}
 }
@@ -0,0 +1,411 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/hizkifw/lmrouter/message"
+)
+
+// backend is an inference server the agent forwards requests from the hub to.
+// Backends relay their responses to the hub in the OpenAI format, whatever API
+// they speak.
+type backend interface {
+	// models lists the models served by the backend
+	models() ([]message.Model, error)
+
+	// slots returns how many requests the backend can process in parallel
+	slots() (int, error)
+
+	// completions serves a completions request, relaying the responses to
+	// the hub under the request id until ctx is cancelled
+	completions(id string, req message.CompletionsRequest, mb *message.MessageBuffer, ctx context.Context)
+
+	// chatCompletions serves a chat completions request
+	chatCompletions(id string, req message.ChatCompletionsRequest, mb *message.MessageBuffer, ctx context.Context)
+
+	// embeddings serves an embeddings request
+	embeddings(id string, req message.EmbeddingsRequest, mb *message.MessageBuffer, ctx context.Context)
+}
+
+// InferenceBackend is an inference server given with --inference, as its
+// address optionally followed by semicolon-separated options, e.g.
+// "http://localhost:5000;type=tgi;auth=Bearer abc;models=llama-*,mistral-7b".
+type InferenceBackend struct {
+	// Addr is the address of the inference server
+	Addr url.URL
+
+	// Type is the API spoken by the server, --backend-type if empty
+	Type string
+
+	// Authorization is the value of the Authorization header sent to the
+	// server, --inference-authorization if empty
+	Authorization string
+
+	// Models are glob patterns of the models of the server to serve. If
+	// empty, all of them are served.
+	Models []string
+}
+
+func (b *InferenceBackend) UnmarshalText(text []byte) error {
+	addr, options, _ := strings.Cut(string(text), ";")
+	u, err := url.Parse(addr)
+	if err != nil {
+		return fmt.Errorf("invalid inference server address: %w", err)
+	}
+	b.Addr = *u
+
+	for _, option := range strings.Split(options, ";") {
+		if option == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(option, "=")
+		switch key {
+		case "type":
+			b.Type = value
+		case "auth":
+			b.Authorization = value
+		case "models":
+			b.Models = strings.Split(value, ",")
+			for _, pattern := range b.Models {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return fmt.Errorf("invalid model pattern %q: %w", pattern, err)
+				}
+			}
+		default:
+			return fmt.Errorf("unknown inference server option %q", key)
+		}
+	}
+	return nil
+}
+
+// servesModel reports whether the model passes the model filter.
+func (b *InferenceBackend) servesModel(model string) bool {
+	if len(b.Models) == 0 {
+		return true
+	}
+	for _, pattern := range b.Models {
+		if ok, _ := path.Match(pattern, model); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// newBackend creates the backend serving requests for the inference servers
+// given in the options.
+func newBackend(opts *AgentOpts) (backend, error) {
+	servers := opts.Inference
+	if len(servers) == 0 {
+		servers = []InferenceBackend{{Addr: url.URL{Scheme: "http", Host: "localhost:5000"}}}
+	}
+
+	client := &http.Client{}
+	members := make([]*poolMember, 0, len(servers))
+	for _, server := range servers {
+		if server.Type == "" {
+			server.Type = opts.BackendType
+		}
+		if server.Authorization == "" {
+			server.Authorization = opts.InferenceAuthorization
+		}
+
+		be, err := newTypedBackend(server, client)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, &poolMember{backend: be, server: server})
+	}
+
+	return newBackendPool(members), nil
+}
+
+// newTypedBackend creates the backend for an inference server according to
+// the API it speaks.
+func newTypedBackend(server InferenceBackend, client *http.Client) (backend, error) {
+	hb := httpBackend{
+		addr:          server.Addr,
+		authorization: server.Authorization,
+		client:        client,
+	}
+
+	switch server.Type {
+	case "", "openai":
+		return &openaiBackend{hb}, nil
+	case "llamacpp":
+		return &llamacppBackend{openaiBackend{hb}}, nil
+	case "tgi":
+		return &tgiBackend{openaiBackend{hb}}, nil
+	case "ollama":
+		return &ollamaBackend{openaiBackend{hb}}, nil
+	default:
+		return nil, fmt.Errorf("unknown backend type %q", server.Type)
+	}
+}
+
+// httpBackend is an inference server reachable over HTTP.
+type httpBackend struct {
+	addr          url.URL
+	authorization string
+	client        *http.Client
+}
+
+// getJSON queries an endpoint of the backend and decodes the JSON response
+// into dest.
+func (b *httpBackend) getJSON(path string, dest any) error {
+	httpReq, err := http.NewRequest("GET", b.addr.JoinPath(path).String(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	if b.authorization != "" {
+		httpReq.Header.Set("Authorization", b.authorization)
+	}
+
+	resp, err := b.client.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(dest); err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
+
+// post sends a request to an endpoint of the backend. If it fails, the error
+// is reported to the hub and nil is returned.
+func (b *httpBackend) post(path string, id string, payload any, mb *message.MessageBuffer, ctx context.Context) *http.Response {
+	// Marshal the request into JSON
+	reqBody, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("failed to marshal request: %v", err)
+		sendError(mb, id, http.StatusBadRequest, "invalid_request_error", "failed to marshal request")
+		return nil
+	}
+
+	// Create a new HTTP request
+	endpoint := b.addr.JoinPath(path).String()
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewBuffer(reqBody))
+	if err != nil {
+		log.Printf("failed to create request: %v", err)
+		sendError(mb, id, http.StatusInternalServerError, "server_error", "failed to create request")
+		return nil
+	}
+
+	if b.authorization != "" {
+		httpReq.Header.Set("Authorization", b.authorization)
+	}
+
+	// Set the Content-Type header
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	// Send the HTTP request
+	resp, err := b.client.Do(httpReq)
+	if err != nil {
+		if ctx.Err() != nil {
+			log.Printf("request %s cancelled", id)
+			sendDone(mb, id)
+			return nil
+		}
+		log.Printf("failed to send request: %v", err)
+		sendError(mb, id, http.StatusBadGateway, "server_error", "failed to reach inference server")
+		return nil
+	}
+
+	// Check the HTTP response status
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("unexpected response status: %v", resp.Status)
+		relayError(mb, id, resp)
+		resp.Body.Close()
+		return nil
+	}
+
+	return resp
+}
+
+// nativeChunk is a response of a backend that does not speak the OpenAI API,
+// as parsed by the backend.
+type nativeChunk struct {
+	// text is the text generated since the previous chunk
+	text string
+
+	// done is set on the last chunk, along with the finish reason and usage
+	done         bool
+	finishReason string
+	usage        *message.CompletionsUsage
+
+	// err is an error reported by the backend
+	err string
+}
+
+// relayNative sends a request to an endpoint of a backend that does not speak
+// the OpenAI API and relays the responses to the hub as OpenAI completions, or
+// chat completions if chat is set. Each response is parsed with parse. Streamed
+// responses are read line by line, either as SSE or as newline-delimited JSON.
+func (b *httpBackend) relayNative(
+	path string, id string, model string, chat bool, payload any, stream bool,
+	parse func(data []byte) (nativeChunk, error),
+	mb *message.MessageBuffer, ctx context.Context,
+) {
+	resp := b.post(path, id, payload, mb, ctx)
+	if resp == nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	created := time.Now().Unix()
+	failed := false
+	relay := func(data []byte) bool {
+		chunk, err := parse(data)
+		if err != nil {
+			log.Printf("failed to parse response: %v", err)
+			sendError(mb, id, http.StatusBadGateway, "server_error", "failed to parse response from inference server")
+			failed = true
+			return false
+		}
+		if chunk.err != "" {
+			log.Printf("inference server error: %v", chunk.err)
+			sendError(mb, id, http.StatusBadGateway, "server_error", chunk.err)
+			failed = true
+			return false
+		}
+		if !stream {
+			// The whole response is in a single chunk
+			chunk.done = true
+		}
+		if chunk.text == "" && !chunk.done {
+			return true
+		}
+
+		// Send the translated response back to the server, giving up on the
+		// request if the hub can no longer be reached
+		msg, _ := json.Marshal(openaiResponse(id, model, created, chat, stream, chunk))
+		if _, err := message.Send[json.RawMessage](mb, &message.TypedMessage[json.RawMessage]{
+			Type:    message.MTCompletionsResponse,
+			Id:      id,
+			Message: msg,
+		}); err != nil {
+			log.Printf("failed to send completions response: %v", err)
+			failed = true
+			return false
+		}
+		return !chunk.done
+	}
+
+	// Handle non-streaming response
+	if !stream {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			log.Printf("failed to read response body: %v", err)
+			sendError(mb, id, http.StatusBadGateway, "server_error", "failed to read response from inference server")
+			return
+		}
+		relay(body)
+		return
+	}
+
+	// Scan the response body
+	reader := bufio.NewReader(resp.Body)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if (err != nil && err != io.EOF) || ctx.Err() != nil {
+			if ctx.Err() != nil {
+				log.Printf("request %s cancelled", id)
+				sendDone(mb, id)
+				return
+			}
+			log.Printf("failed to read response body: %v", err)
+			sendError(mb, id, http.StatusBadGateway, "server_error", "failed to read response from inference server")
+			return
+		}
+
+		data := bytes.TrimSpace(line)
+		if d, ok := bytes.CutPrefix(data, []byte("data:")); ok {
+			data = bytes.TrimSpace(d)
+		}
+		if len(data) > 0 && data[0] == '{' && !relay(data) {
+			break
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+
+	if !failed {
+		sendDone(mb, id)
+	}
+}
+
+// openaiResponse builds the OpenAI response holding a native chunk.
+func openaiResponse(id string, model string, created int64, chat bool, stream bool, chunk nativeChunk) any {
+	var finishReason *string
+	if chunk.done {
+		finishReason = &chunk.finishReason
+	}
+
+	if !chat {
+		return message.CompletionsResponse{
+			ID:      "cmpl-" + id,
+			Object:  "text_completion",
+			Created: created,
+			Model:   model,
+			Choices: []message.CompletionsChoice{{Text: chunk.text, FinishReason: finishReason}},
+			Usage:   chunk.usage,
+		}
+	}
+
+	resp := message.ChatCompletionsResponse{
+		ID:      "chatcmpl-" + id,
+		Object:  "chat.completion",
+		Created: created,
+		Model:   model,
+		Choices: []message.ChatCompletionsChoice{{FinishReason: finishReason}},
+		Usage:   chunk.usage,
+	}
+	msg := &message.ChatMessage{Role: "assistant", Content: chunk.text}
+	if stream {
+		resp.Object = "chat.completion.chunk"
+		resp.Choices[0].Delta = msg
+	} else {
+		resp.Choices[0].Message = msg
+	}
+	return resp
+}
+
+// stopSequences returns the stop sequences of an OpenAI request, which are
+// either a string or a list of strings.
+func stopSequences(stop *interface{}) []string {
+	if stop == nil {
+		return nil
+	}
+	switch s := (*stop).(type) {
+	case string:
+		return []string{s}
+	case []interface{}:
+		seqs := make([]string, 0, len(s))
+		for _, seq := range s {
+			if str, ok := seq.(string); ok {
+				seqs = append(seqs, str)
+			}
+		}
+		return seqs
+	default:
+		return nil
+	}
+}
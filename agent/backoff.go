@@ -0,0 +1,44 @@
+package agent
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// backoff computes jittered exponential delays between reconnection attempts.
+type backoff struct {
+	min     time.Duration
+	max     time.Duration
+	attempt int
+}
+
+func newBackoff(min, max time.Duration) *backoff {
+	if min <= 0 {
+		min = time.Second
+	}
+	if max < min {
+		max = min
+	}
+	return &backoff{min: min, max: max}
+}
+
+// next returns the delay before the next attempt. The delay doubles with every
+// attempt up to the maximum, and is randomized between half and the full value
+// so that agents do not all reconnect at the same time.
+func (b *backoff) next() time.Duration {
+	d := b.max
+	if b.attempt < 32 {
+		if exp := b.min << b.attempt; exp > 0 && exp < b.max {
+			d = exp
+		}
+	}
+	b.attempt++
+
+	half := d / 2
+	return half + rand.N(d-half+1)
+}
+
+// reset starts the delays over from the minimum.
+func (b *backoff) reset() {
+	b.attempt = 0
+}
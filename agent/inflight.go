@@ -0,0 +1,76 @@
+package agent
+
+import (
+	"context"
+	"sync"
+)
+
+// inflight keeps track of the requests currently being processed by the agent
+// so that they can be cancelled by the hub, or waited for when draining.
+type inflight struct {
+	cancels map[string]context.CancelFunc
+	idle    chan struct{}
+	lock    sync.Mutex
+}
+
+func newInflight() *inflight {
+	return &inflight{
+		cancels: make(map[string]context.CancelFunc),
+	}
+}
+
+// start registers a request and returns a context that is cancelled when the
+// hub cancels the request. The returned function must be called once the
+// request has completed.
+func (f *inflight) start(id string, ctx context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	f.lock.Lock()
+	f.cancels[id] = cancel
+	f.lock.Unlock()
+
+	return ctx, func() {
+		f.lock.Lock()
+		delete(f.cancels, id)
+		if len(f.cancels) == 0 && f.idle != nil {
+			close(f.idle)
+			f.idle = nil
+		}
+		f.lock.Unlock()
+		cancel()
+	}
+}
+
+// cancel aborts the request with the given id, if it is still running.
+func (f *inflight) cancel(id string) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	cancel, ok := f.cancels[id]
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+// wait blocks until no requests are in progress, returning false if ctx is
+// done first.
+func (f *inflight) wait(ctx context.Context) bool {
+	f.lock.Lock()
+	if len(f.cancels) == 0 {
+		f.lock.Unlock()
+		return true
+	}
+	if f.idle == nil {
+		f.idle = make(chan struct{})
+	}
+	idle := f.idle
+	f.lock.Unlock()
+
+	select {
+	case <-idle:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,101 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/hizkifw/lmrouter/message"
+)
+
+// llamacppBackend is a llama.cpp server, whose native /completion endpoint is
+// used for completions. Chat completions and embeddings have no native
+// equivalent and go through its OpenAI-compatible API.
+type llamacppBackend struct {
+	openaiBackend
+}
+
+// llamacppCompletionRequest is a request to the llama.cpp /completion endpoint.
+type llamacppCompletionRequest struct {
+	Prompt      string   `json:"prompt"`
+	NPredict    *int     `json:"n_predict,omitempty"`
+	Temperature *float32 `json:"temperature,omitempty"`
+	TopP        *float32 `json:"top_p,omitempty"`
+	Stop        []string `json:"stop,omitempty"`
+	Seed        *int     `json:"seed,omitempty"`
+	Stream      bool     `json:"stream"`
+}
+
+// llamacppCompletionResponse is a response, or a streamed chunk, of the
+// llama.cpp /completion endpoint.
+type llamacppCompletionResponse struct {
+	Content         string `json:"content"`
+	Stop            bool   `json:"stop"`
+	StoppedLimit    bool   `json:"stopped_limit"`
+	TokensPredicted int    `json:"tokens_predicted"`
+	TokensEvaluated int    `json:"tokens_evaluated"`
+	Error           *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// models returns the model loaded by the server, named after its file.
+func (b *llamacppBackend) models() ([]message.Model, error) {
+	var props struct {
+		ModelPath                 string `json:"model_path"`
+		DefaultGenerationSettings struct {
+			Model string `json:"model"`
+		} `json:"default_generation_settings"`
+	}
+	if err := b.getJSON("/props", &props); err != nil {
+		return nil, err
+	}
+
+	modelPath := props.ModelPath
+	if modelPath == "" {
+		modelPath = props.DefaultGenerationSettings.Model
+	}
+	if modelPath == "" {
+		return nil, fmt.Errorf("inference server reported no model")
+	}
+	id := strings.TrimSuffix(path.Base(modelPath), ".gguf")
+	return []message.Model{{Id: id, Object: "model", OwnedBy: "llamacpp"}}, nil
+}
+
+func (b *llamacppBackend) completions(id string, req message.CompletionsRequest, mb *message.MessageBuffer, ctx context.Context) {
+	nativeReq := llamacppCompletionRequest{
+		Prompt:      req.Prompt,
+		NPredict:    req.MaxTokens,
+		Temperature: req.Temperature,
+		TopP:        req.TopP,
+		Stop:        stopSequences(req.Stop),
+		Seed:        req.Seed,
+		Stream:      req.Stream,
+	}
+	b.relayNative("/completion", id, req.Model, false, nativeReq, req.Stream, parseLlamacppResponse, mb, ctx)
+}
+
+func parseLlamacppResponse(data []byte) (nativeChunk, error) {
+	var resp llamacppCompletionResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nativeChunk{}, err
+	}
+	if resp.Error != nil {
+		return nativeChunk{err: resp.Error.Message}, nil
+	}
+
+	chunk := nativeChunk{text: resp.Content, done: resp.Stop, finishReason: "stop"}
+	if resp.StoppedLimit {
+		chunk.finishReason = "length"
+	}
+	if resp.Stop {
+		chunk.usage = &message.CompletionsUsage{
+			PromptTokens:     resp.TokensEvaluated,
+			CompletionTokens: resp.TokensPredicted,
+			TotalTokens:      resp.TokensEvaluated + resp.TokensPredicted,
+		}
+	}
+	return chunk, nil
+}
@@ -0,0 +1,132 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hizkifw/lmrouter/message"
+)
+
+// ollamaBackend is an Ollama daemon, whose native /api/generate and /api/chat
+// endpoints are used for completions and chat completions. Embeddings go
+// through its OpenAI-compatible API.
+type ollamaBackend struct {
+	openaiBackend
+}
+
+// ollamaResponse is a response, or a streamed chunk, of the Ollama generate
+// and chat endpoints.
+type ollamaResponse struct {
+	Response string                 `json:"response"`
+	Message  *message.OllamaMessage `json:"message"`
+	Error    string                 `json:"error"`
+	message.OllamaStats
+}
+
+func (b *ollamaBackend) models() ([]message.Model, error) {
+	var tags message.OllamaTagsResponse
+	if err := b.getJSON("/api/tags", &tags); err != nil {
+		return nil, err
+	}
+
+	models := make([]message.Model, 0, len(tags.Models))
+	for _, m := range tags.Models {
+		models = append(models, message.Model{Id: m.Name, Object: "model", OwnedBy: "ollama"})
+	}
+	return models, nil
+}
+
+func (b *ollamaBackend) slots() (int, error) {
+	return 0, fmt.Errorf("ollama does not report how many requests it processes in parallel")
+}
+
+// ollamaOptions returns the Ollama options equivalent to the sampling
+// parameters of an OpenAI request.
+func ollamaOptions(maxTokens *int, temperature *float32, topP *float32, seed *int, stop *interface{}) *message.OllamaOptions {
+	opts := &message.OllamaOptions{
+		NumPredict:  maxTokens,
+		Temperature: temperature,
+		TopP:        topP,
+		Seed:        seed,
+	}
+	if seqs := stopSequences(stop); len(seqs) > 0 {
+		var s interface{} = seqs
+		opts.Stop = &s
+	}
+	return opts
+}
+
+func (b *ollamaBackend) completions(id string, req message.CompletionsRequest, mb *message.MessageBuffer, ctx context.Context) {
+	nativeReq := message.OllamaGenerateRequest{
+		Model:   req.Model,
+		Prompt:  req.Prompt,
+		Raw:     true,
+		Stream:  &req.Stream,
+		Options: ollamaOptions(req.MaxTokens, req.Temperature, req.TopP, req.Seed, req.Stop),
+	}
+	if req.Suffix != nil {
+		nativeReq.Suffix = *req.Suffix
+	}
+	b.relayNative("/api/generate", id, req.Model, false, nativeReq, req.Stream, parseOllamaResponse, mb, ctx)
+}
+
+func (b *ollamaBackend) chatCompletions(id string, req message.ChatCompletionsRequest, mb *message.MessageBuffer, ctx context.Context) {
+	nativeReq := message.OllamaChatRequest{
+		Model:    req.Model,
+		Messages: make([]message.OllamaMessage, 0, len(req.Messages)),
+		Stream:   &req.Stream,
+		Options:  ollamaOptions(req.MaxTokens, req.Temperature, req.TopP, req.Seed, req.Stop),
+	}
+	for _, m := range req.Messages {
+		nativeReq.Messages = append(nativeReq.Messages, message.OllamaMessage{Role: m.Role, Content: chatText(m.Content)})
+	}
+	b.relayNative("/api/chat", id, req.Model, true, nativeReq, req.Stream, parseOllamaResponse, mb, ctx)
+}
+
+func parseOllamaResponse(data []byte) (nativeChunk, error) {
+	var resp ollamaResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nativeChunk{}, err
+	}
+	if resp.Error != "" {
+		return nativeChunk{err: resp.Error}, nil
+	}
+
+	chunk := nativeChunk{text: resp.Response, done: resp.Done, finishReason: "stop"}
+	if resp.Message != nil {
+		chunk.text = resp.Message.Content
+	}
+	if resp.DoneReason == "length" {
+		chunk.finishReason = "length"
+	}
+	if resp.Done {
+		chunk.usage = &message.CompletionsUsage{
+			PromptTokens:     resp.PromptEvalCount,
+			CompletionTokens: resp.EvalCount,
+			TotalTokens:      resp.PromptEvalCount + resp.EvalCount,
+		}
+	}
+	return chunk, nil
+}
+
+// chatText returns the text of chat message content, which is either a string
+// or a list of content parts.
+func chatText(content interface{}) string {
+	switch c := content.(type) {
+	case string:
+		return c
+	case []interface{}:
+		var text strings.Builder
+		for _, part := range c {
+			if p, ok := part.(map[string]interface{}); ok && p["type"] == "text" {
+				s, _ := p["text"].(string)
+				text.WriteString(s)
+			}
+		}
+		return text.String()
+	default:
+		return ""
+	}
+}
@@ -3,6 +3,7 @@ package agent
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -12,85 +13,80 @@ import (
 	"github.com/hizkifw/lmrouter/message"
 )
 
-func queryModels(opts *AgentOpts, client *http.Client) ([]message.Model, error) {
-	endpoint := opts.InferenceAddr.JoinPath("/v1/models").String()
-	httpReq, err := http.NewRequest("GET", endpoint, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
-	}
-
-	if opts.InferenceAuthorization != "" {
-		httpReq.Header.Set("Authorization", opts.InferenceAuthorization)
-	}
-
-	resp, err := client.Do(httpReq)
-	if err != nil {
-		return nil, fmt.Errorf("failed to send request: %w", err)
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected response status: %s", resp.Status)
-	}
+// openaiBackend is an inference server with an OpenAI-compatible API.
+type openaiBackend struct {
+	httpBackend
+}
 
+func (b *openaiBackend) models() ([]message.Model, error) {
 	var models message.ListModelsResponse
-	if err := json.NewDecoder(resp.Body).Decode(&models); err != nil {
-		return nil, fmt.Errorf("failed to decode response: %w", err)
+	if err := b.getJSON("/v1/models", &models); err != nil {
+		return nil, err
 	}
-
 	return models.Data, nil
 }
 
-func handleCompletions(
-	opts *AgentOpts, req *message.TypedMessage[message.CompletionsRequest],
-	client *http.Client, mb *message.MessageBuffer,
-) {
-	// Marshal the request into JSON
-	reqBody, err := json.Marshal(req.Message)
-	if err != nil {
-		log.Printf("failed to marshal request: %v", err)
-		return
+// slots asks the inference server how many requests it can process in
+// parallel. This is supported by the llama.cpp server, through either the
+// /props or the /slots endpoint.
+func (b *openaiBackend) slots() (int, error) {
+	var props struct {
+		TotalSlots int `json:"total_slots"`
 	}
-
-	// Create a new HTTP request
-	endpoint := opts.InferenceAddr.JoinPath("/v1/completions").String()
-	httpReq, err := http.NewRequest("POST", endpoint, bytes.NewBuffer(reqBody))
-	if err != nil {
-		log.Printf("failed to create request: %v", err)
-		return
+	if err := b.getJSON("/props", &props); err == nil && props.TotalSlots > 0 {
+		return props.TotalSlots, nil
 	}
 
-	if opts.InferenceAuthorization != "" {
-		httpReq.Header.Set("Authorization", opts.InferenceAuthorization)
+	var slots []json.RawMessage
+	if err := b.getJSON("/slots", &slots); err != nil {
+		return 0, err
+	}
+	if len(slots) == 0 {
+		return 0, fmt.Errorf("inference server reported no slots")
 	}
+	return len(slots), nil
+}
 
-	// Set the Content-Type header
-	httpReq.Header.Set("Content-Type", "application/json")
+func (b *openaiBackend) completions(id string, req message.CompletionsRequest, mb *message.MessageBuffer, ctx context.Context) {
+	b.proxy("/v1/completions", id, req, req.Stream, mb, ctx)
+}
 
-	// Send the HTTP request
-	resp, err := client.Do(httpReq)
-	if err != nil {
-		log.Printf("failed to send request: %v", err)
-		return
-	}
-	defer resp.Body.Close()
+func (b *openaiBackend) chatCompletions(id string, req message.ChatCompletionsRequest, mb *message.MessageBuffer, ctx context.Context) {
+	b.proxy("/v1/chat/completions", id, req, req.Stream, mb, ctx)
+}
 
-	// Check the HTTP response status
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("unexpected response status: %v", resp.Status)
+func (b *openaiBackend) embeddings(id string, req message.EmbeddingsRequest, mb *message.MessageBuffer, ctx context.Context) {
+	b.proxy("/v1/embeddings", id, req, false, mb, ctx)
+}
+
+// proxy forwards a request to the given endpoint on the inference server and
+// relays the response back to the hub under the request id. The request to the
+// inference server is aborted when ctx is cancelled.
+func (b *openaiBackend) proxy(
+	path string, id string, payload any, stream bool,
+	mb *message.MessageBuffer, ctx context.Context,
+) {
+	resp := b.post(path, id, payload, mb, ctx)
+	if resp == nil {
 		return
 	}
+	defer resp.Body.Close()
 
 	// Handle non-streaming response
-	if !req.Message.Stream {
-		// Unmarshal the response body into a CompletionsResponse
-		compResp := message.TypedMessage[message.CompletionsResponse]{
+	if !stream {
+		// Relay the response body as-is
+		compResp := message.TypedMessage[json.RawMessage]{
 			Type: message.MTCompletionsResponse,
-			Id:   req.Id,
+			Id:   id,
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&compResp.Message); err != nil && ctx.Err() != nil {
+			log.Printf("request %s cancelled", id)
+			sendDone(mb, id)
+			return
 		}
-		json.NewDecoder(resp.Body).Decode(&compResp.Message)
 
 		// Send the completions response back to the server
-		if _, err := message.Send[message.CompletionsResponse](mb, &compResp); err != nil {
+		if _, err := message.Send[json.RawMessage](mb, &compResp); err != nil {
 			log.Printf("failed to send completions response: %v", err)
 		}
 		return
@@ -101,8 +97,15 @@ func handleCompletions(
 	for {
 		line, err := reader.ReadBytes('\n')
 		if err != nil {
+			if ctx.Err() != nil {
+				log.Printf("request %s cancelled", id)
+				sendDone(mb, id)
+				return
+			}
 			if err != io.EOF {
 				log.Printf("failed to read response body: %v", err)
+				sendError(mb, id, http.StatusBadGateway, "server_error", "failed to read response from inference server")
+				return
 			}
 			break
 		}
@@ -124,21 +127,71 @@ func handleCompletions(
 		// Construct a CompletionsResponse
 		compResp := message.TypedMessage[json.RawMessage]{
 			Type:    message.MTCompletionsResponse,
-			Id:      req.Id,
+			Id:      id,
 			Message: line,
 		}
 
-		// Send the completions response back to the server
+		// Send the completions response back to the server, giving up on the
+		// request if the hub can no longer be reached
 		if _, err := message.Send[json.RawMessage](mb, &compResp); err != nil {
 			log.Printf("failed to send completions response: %v", err)
+			return
 		}
 	}
 
+	sendDone(mb, id)
+}
+
+// sendDone tells the hub that no more replies will be sent for the request.
+func sendDone(mb *message.MessageBuffer, id string) {
 	if _, err := message.Send[string](mb, &message.TypedMessage[string]{
 		Type:    message.MTCompletionsDone,
-		Id:      req.Id,
+		Id:      id,
 		Message: "done",
 	}); err != nil {
 		log.Printf("failed to send completions done message: %v", err)
 	}
 }
+
+// relayError forwards a non-200 response from the inference server to the hub,
+// wrapping the body in an OpenAI-style error if it is not already JSON. Errors
+// of the form {"error": "message"}, as returned by TGI and Ollama, are wrapped
+// too.
+func relayError(mb *message.MessageBuffer, id string, resp *http.Response) {
+	body, err := io.ReadAll(resp.Body)
+	if err != nil || !json.Valid(body) {
+		sendError(mb, id, resp.StatusCode, "server_error", fmt.Sprintf(
+			"inference server returned %s: %s", resp.Status, bytes.TrimSpace(body)))
+		return
+	}
+	var native struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(body, &native) == nil && native.Error != "" {
+		sendError(mb, id, resp.StatusCode, "server_error", native.Error)
+		return
+	}
+
+	if _, err := message.Send[message.CompletionsError](mb, &message.TypedMessage[message.CompletionsError]{
+		Type:    message.MTCompletionsError,
+		Id:      id,
+		Message: message.CompletionsError{StatusCode: resp.StatusCode, Body: body},
+	}); err != nil {
+		log.Printf("failed to send completions error: %v", err)
+	}
+}
+
+// sendError sends an OpenAI-style error with the given status code to the hub.
+func sendError(mb *message.MessageBuffer, id string, statusCode int, typ string, msg string) {
+	body, _ := json.Marshal(message.ErrorResponse{
+		Error: message.ErrorDetail{Message: msg, Type: typ},
+	})
+
+	if _, err := message.Send[message.CompletionsError](mb, &message.TypedMessage[message.CompletionsError]{
+		Type:    message.MTCompletionsError,
+		Id:      id,
+		Message: message.CompletionsError{StatusCode: statusCode, Body: body},
+	}); err != nil {
+		log.Printf("failed to send completions error: %v", err)
+	}
+}
@@ -0,0 +1,225 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sync"
+
+	"github.com/hizkifw/lmrouter/message"
+)
+
+// backendPool spreads requests over the inference servers of the agent,
+// sending each to the least loaded server serving its model. Its models and
+// slots are those of all its members combined, so that the agent registers
+// with the hub as a single worker.
+//
+// The hub only knows the slots of the worker as a whole, so it may send more
+// requests for a model than the members serving it have slots for, when the
+// members serve different models. Those requests wait in the pool until a
+// member serving the model frees up.
+type backendPool struct {
+	members []*poolMember
+	lock    sync.Mutex
+
+	// freed is closed and replaced whenever a request completes, waking up
+	// requests waiting for a member slot
+	freed chan struct{}
+}
+
+// poolMember is an inference server of a backend pool.
+type poolMember struct {
+	backend backend
+	server  InferenceBackend
+
+	// models are the models the server served when last queried
+	models []string
+
+	// slots is how many requests the server processes at once, 0 if unknown
+	slots int
+
+	// active is the number of requests in progress on the server, and total
+	// the number of requests sent to it
+	active int
+	total  int
+}
+
+func newBackendPool(members []*poolMember) *backendPool {
+	return &backendPool{members: members, freed: make(chan struct{})}
+}
+
+// models queries the models of every member, keeping those passing its model
+// filter. Members that cannot be queried are skipped until the next query, and
+// an error is only returned if none could be.
+func (p *backendPool) models() ([]message.Model, error) {
+	merged := make([]message.Model, 0)
+	seen := make(map[string]bool)
+	var lastErr error
+	for _, m := range p.members {
+		models, err := m.backend.models()
+		if err != nil {
+			if len(p.members) > 1 {
+				log.Printf("Failed to query models of %s: %v", m.server.Addr.String(), err)
+			}
+			lastErr = err
+		}
+
+		ids := make([]string, 0, len(models))
+		for _, model := range models {
+			if !m.server.servesModel(model.Id) {
+				continue
+			}
+			ids = append(ids, model.Id)
+			if !seen[model.Id] {
+				seen[model.Id] = true
+				merged = append(merged, model)
+			}
+		}
+
+		p.lock.Lock()
+		m.models = ids
+		p.lock.Unlock()
+	}
+
+	if len(merged) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	return merged, nil
+}
+
+// slots returns the total number of requests the members serving models
+// process at once. It fails if any of them cannot tell, as the total would be
+// wrong.
+func (p *backendPool) slots() (int, error) {
+	total := 0
+	var lastErr error
+	for _, m := range p.members {
+		p.lock.Lock()
+		serving := len(m.models) > 0
+		p.lock.Unlock()
+		if !serving {
+			continue
+		}
+
+		n, err := m.backend.slots()
+		if err != nil {
+			lastErr = err
+			n = 0
+		}
+
+		p.lock.Lock()
+		m.slots = n
+		p.lock.Unlock()
+		total += n
+	}
+
+	if lastErr != nil {
+		return 0, lastErr
+	}
+	return total, nil
+}
+
+// acquire picks the member with the lowest load relative to its slots among
+// those serving the model, taking turns between equally loaded ones, and counts
+// the request against it. Members whose filter allows the model without listing
+// it, as it may have been loaded since they were last queried, are only picked
+// if no member lists it. If all the members serving the model are full, it
+// waits for one of them to free up. It returns nil if no member can serve the
+// model, or if ctx is cancelled while waiting.
+func (p *backendPool) acquire(model string, ctx context.Context) *poolMember {
+	for {
+		p.lock.Lock()
+		best, serving := p.pick(model)
+		if best != nil {
+			best.active++
+			best.total++
+		}
+		freed := p.freed
+		p.lock.Unlock()
+
+		if best != nil || !serving {
+			return best
+		}
+
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// pick returns the member acquire should send a request for the model to, or
+// nil if there is none with a free slot. It also reports whether any member
+// serves the model at all. Must be called with p.lock held.
+func (p *backendPool) pick(model string) (*poolMember, bool) {
+	var best *poolMember
+	var bestScore float64
+	serving := false
+	for _, listed := range []bool{true, false} {
+		for _, m := range p.members {
+			if (listed && !slices.Contains(m.models, model)) || (!listed && !m.server.servesModel(model)) {
+				continue
+			}
+			serving = true
+			if m.slots > 0 && m.active >= m.slots {
+				continue
+			}
+			score := float64(m.active+1) / float64(max(m.slots, 1))
+			if best == nil || score < bestScore || (score == bestScore && m.total < best.total) {
+				best, bestScore = m, score
+			}
+		}
+		if serving {
+			break
+		}
+	}
+	return best, serving
+}
+
+func (p *backendPool) release(m *poolMember) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	m.active--
+
+	close(p.freed)
+	p.freed = make(chan struct{})
+}
+
+// serve runs a request on the member selected for the model, or reports to
+// the hub that the model is not served.
+func (p *backendPool) serve(id string, model string, mb *message.MessageBuffer, fn func(be backend), ctx context.Context) {
+	m := p.acquire(model, ctx)
+	if m == nil {
+		if ctx.Err() != nil {
+			// The request was cancelled while waiting for a member
+			return
+		}
+		sendError(mb, id, http.StatusNotFound, "invalid_request_error",
+			fmt.Sprintf("model '%s' is not served by this worker", model))
+		return
+	}
+	defer p.release(m)
+
+	fn(m.backend)
+}
+
+func (p *backendPool) completions(id string, req message.CompletionsRequest, mb *message.MessageBuffer, ctx context.Context) {
+	p.serve(id, req.Model, mb, func(be backend) {
+		be.completions(id, req, mb, ctx)
+	}, ctx)
+}
+
+func (p *backendPool) chatCompletions(id string, req message.ChatCompletionsRequest, mb *message.MessageBuffer, ctx context.Context) {
+	p.serve(id, req.Model, mb, func(be backend) {
+		be.chatCompletions(id, req, mb, ctx)
+	}, ctx)
+}
+
+func (p *backendPool) embeddings(id string, req message.EmbeddingsRequest, mb *message.MessageBuffer, ctx context.Context) {
+	p.serve(id, req.Model, mb, func(be backend) {
+		be.embeddings(id, req, mb, ctx)
+	}, ctx)
+}
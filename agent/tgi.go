@@ -0,0 +1,131 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hizkifw/lmrouter/message"
+)
+
+// tgiBackend is a HuggingFace Text Generation Inference server, whose native
+// /generate and /generate_stream endpoints are used for completions. Chat
+// completions and embeddings go through its OpenAI-compatible API.
+type tgiBackend struct {
+	openaiBackend
+}
+
+// tgiGenerateRequest is a request to the TGI generate endpoints.
+type tgiGenerateRequest struct {
+	Inputs     string        `json:"inputs"`
+	Parameters tgiParameters `json:"parameters"`
+}
+
+type tgiParameters struct {
+	MaxNewTokens *int     `json:"max_new_tokens,omitempty"`
+	Temperature  *float32 `json:"temperature,omitempty"`
+	TopP         *float32 `json:"top_p,omitempty"`
+	Stop         []string `json:"stop,omitempty"`
+	Seed         *int     `json:"seed,omitempty"`
+	Details      bool     `json:"details"`
+}
+
+// tgiGenerateResponse is a response of /generate, or a streamed event of
+// /generate_stream.
+type tgiGenerateResponse struct {
+	Token *struct {
+		Text    string `json:"text"`
+		Special bool   `json:"special"`
+	} `json:"token"`
+	GeneratedText *string `json:"generated_text"`
+	Details       *struct {
+		FinishReason    string `json:"finish_reason"`
+		GeneratedTokens int    `json:"generated_tokens"`
+	} `json:"details"`
+	Error string `json:"error"`
+}
+
+// tgiInfo is the response of the TGI /info endpoint.
+type tgiInfo struct {
+	ModelId               string `json:"model_id"`
+	MaxConcurrentRequests int    `json:"max_concurrent_requests"`
+}
+
+func (b *tgiBackend) models() ([]message.Model, error) {
+	var info tgiInfo
+	if err := b.getJSON("/info", &info); err != nil {
+		return nil, err
+	}
+	if info.ModelId == "" {
+		return nil, fmt.Errorf("inference server reported no model")
+	}
+	return []message.Model{{Id: info.ModelId, Object: "model", OwnedBy: "tgi"}}, nil
+}
+
+func (b *tgiBackend) slots() (int, error) {
+	var info tgiInfo
+	if err := b.getJSON("/info", &info); err != nil {
+		return 0, err
+	}
+	if info.MaxConcurrentRequests <= 0 {
+		return 0, fmt.Errorf("inference server reported no concurrency limit")
+	}
+	return info.MaxConcurrentRequests, nil
+}
+
+func (b *tgiBackend) completions(id string, req message.CompletionsRequest, mb *message.MessageBuffer, ctx context.Context) {
+	nativeReq := tgiGenerateRequest{
+		Inputs: req.Prompt,
+		Parameters: tgiParameters{
+			MaxNewTokens: req.MaxTokens,
+			Stop:         stopSequences(req.Stop),
+			Seed:         req.Seed,
+			Details:      true,
+		},
+	}
+
+	// TGI rejects values OpenAI accepts, such as a temperature of 0
+	if req.Temperature != nil && *req.Temperature > 0 {
+		nativeReq.Parameters.Temperature = req.Temperature
+	}
+	if req.TopP != nil && *req.TopP > 0 && *req.TopP < 1 {
+		nativeReq.Parameters.TopP = req.TopP
+	}
+
+	path := "/generate"
+	if req.Stream {
+		path = "/generate_stream"
+	}
+	b.relayNative(path, id, req.Model, false, nativeReq, req.Stream, parseTgiResponse, mb, ctx)
+}
+
+func parseTgiResponse(data []byte) (nativeChunk, error) {
+	var resp tgiGenerateResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nativeChunk{}, err
+	}
+	if resp.Error != "" {
+		return nativeChunk{err: resp.Error}, nil
+	}
+
+	chunk := nativeChunk{finishReason: "stop"}
+	if resp.Token != nil {
+		// Streamed token, the generated text is repeated on the last one
+		if !resp.Token.Special {
+			chunk.text = resp.Token.Text
+		}
+	} else if resp.GeneratedText != nil {
+		chunk.text = *resp.GeneratedText
+	}
+	if resp.Details != nil {
+		chunk.done = true
+		if resp.Details.FinishReason == "length" {
+			chunk.finishReason = "length"
+		}
+		chunk.usage = &message.CompletionsUsage{
+			CompletionTokens: resp.Details.GeneratedTokens,
+			TotalTokens:      resp.Details.GeneratedTokens,
+		}
+	}
+	return chunk, nil
+}
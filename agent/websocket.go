@@ -2,62 +2,208 @@ package agent
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"slices"
+	"time"
 
 	"github.com/hizkifw/lmrouter/message"
 )
 
-func initWebsocket(opts *AgentOpts, done chan struct{}, mb *message.MessageBuffer, ctx context.Context) {
-	defer close(done)
+// errHubShutdown is returned when the hub closes the session because it is
+// shutting down.
+var errHubShutdown = errors.New("hub is shutting down")
 
-	// Query available models
-	client := &http.Client{}
-	models, err := queryModels(opts, client)
+// queryWorkerInfo collects the models and number of slots of the inference
+// server to announce to the hub.
+func queryWorkerInfo(opts *AgentOpts, be backend) (message.WorkerInfo, error) {
+	models, err := be.models()
 	if err != nil {
-		log.Printf("failed to query models: %v", err)
-		return
+		return message.WorkerInfo{}, fmt.Errorf("failed to query models: %w", err)
+	}
+	for i := range models {
+		if slices.Contains(opts.EmbeddingModels, models[i].Id) {
+			models[i].EmbeddingsOnly = true
+		}
+	}
+
+	// Find out how many requests the inference server can handle at once
+	maxConcurrency := opts.MaxConcurrency
+	if maxConcurrency <= 0 {
+		if maxConcurrency, err = be.slots(); err != nil {
+			maxConcurrency = 0
+		}
+	}
+
+	return message.WorkerInfo{
+		WorkerName:      opts.WorkerName,
+		AvailableModels: models,
+		MaxConcurrency:  maxConcurrency,
+	}, nil
+}
+
+// sameWorkerInfo reports whether two worker infos announce the same models and
+// slots, ignoring fields like model creation times.
+func sameWorkerInfo(a, b message.WorkerInfo) bool {
+	if a.MaxConcurrency != b.MaxConcurrency || len(a.AvailableModels) != len(b.AvailableModels) {
+		return false
+	}
+	for i := range a.AvailableModels {
+		if a.AvailableModels[i].Id != b.AvailableModels[i].Id ||
+			a.AvailableModels[i].OwnedBy != b.AvailableModels[i].OwnedBy ||
+			a.AvailableModels[i].EmbeddingsOnly != b.AvailableModels[i].EmbeddingsOnly {
+			return false
+		}
+	}
+	return true
+}
+
+// initWebsocket performs the registration handshake with the hub, returning
+// the information the worker registered with.
+func initWebsocket(opts *AgentOpts, mb *message.MessageBuffer, be backend, ctx context.Context) (message.WorkerInfo, error) {
+	info, err := queryWorkerInfo(opts, be)
+	if err != nil {
+		return info, err
+	}
+	log.Printf("Available models: %v", info.AvailableModels)
+	if opts.MaxConcurrency <= 0 {
+		if info.MaxConcurrency > 0 {
+			log.Printf("Detected %d inference server slots", info.MaxConcurrency)
+		} else {
+			log.Printf("Could not detect inference server slots, not limiting concurrency")
+		}
 	}
-	log.Printf("Available models: %v", models)
 
 	// Wait for server identification
 	serverInfo, err := message.ReceiveType[message.ServerInfo](mb, message.MTServerInfo, ctx)
 	if err != nil {
-		log.Printf("failed to read server info: %v", err)
-		return
+		return info, fmt.Errorf("failed to read server info: %w", err)
 	}
 
 	log.Printf("Registering to server: %#v", serverInfo.Message)
 
-	// Send worker info
-	id, err := message.Send[message.WorkerInfo](mb, &message.TypedMessage[message.WorkerInfo]{
-		Type: message.MTWorkerInfo,
-		Message: message.WorkerInfo{
-			WorkerName:      opts.WorkerName,
-			AvailableModels: models,
-		},
+	// Send worker info, subscribing to the ack first so it is not missed
+	registration := info
+	registration.Token = opts.HubToken
+	id := message.NewId()
+	acks := mb.SubscribeId(id)
+	defer acks.Close()
+	_, err = message.Send[message.WorkerInfo](mb, &message.TypedMessage[message.WorkerInfo]{
+		Type:    message.MTWorkerInfo,
+		Id:      id,
+		Message: registration,
 	})
 	if err != nil {
-		log.Printf("failed to write worker info: %v", err)
-		return
+		return info, fmt.Errorf("failed to write worker info: %w", err)
 	}
 
 	// Wait for ack
-	ackMsg, err := message.ReceiveId[message.Ack](mb, id, ctx)
+	ackMsg, err := message.Receive[message.Ack](acks, ctx)
 	if err != nil {
-		log.Printf("failed to read ack: %v", err)
-		return
+		return info, fmt.Errorf("failed to read ack: %w", err)
 	}
 	if !ackMsg.Message.Ok {
-		log.Printf("registration failed: %v", ackMsg.Message.Message)
-		return
+		return info, fmt.Errorf("registration failed: %v", ackMsg.Message.Message)
 	}
 	log.Printf("Registered worker: %v", ackMsg.Message.Message)
 
+	return info, nil
+}
+
+// refreshWorkerInfo periodically queries the inference server and announces
+// changes to its models or slots to the hub, until ctx is cancelled.
+func refreshWorkerInfo(
+	opts *AgentOpts, mb *message.MessageBuffer, be backend,
+	info message.WorkerInfo, ctx context.Context,
+) {
+	ticker := time.NewTicker(opts.RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		latest, err := queryWorkerInfo(opts, be)
+		if err != nil {
+			log.Printf("Failed to refresh worker info: %v", err)
+			continue
+		}
+		if sameWorkerInfo(info, latest) {
+			continue
+		}
+
+		log.Printf("Worker info changed, available models: %v", latest.AvailableModels)
+		_, err = message.Send[message.WorkerInfo](mb, &message.TypedMessage[message.WorkerInfo]{
+			Type:    message.MTWorkerInfoUpdate,
+			Message: latest,
+		})
+		if err != nil {
+			log.Printf("Failed to send worker info update: %v", err)
+			return
+		}
+		info = latest
+	}
+}
+
+// drainSession tells the hub to stop routing requests to the worker, then waits
+// up to opts.DrainTimeout for the requests in progress to complete.
+func drainSession(opts *AgentOpts, mb *message.MessageBuffer, reqs *inflight, ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, opts.DrainTimeout)
+	defer cancel()
+
+	id := message.NewId()
+	acks := mb.SubscribeId(id)
+	defer acks.Close()
+	_, err := message.Send[string](mb, &message.TypedMessage[string]{
+		Type:    message.MTWorkerDraining,
+		Id:      id,
+		Message: "draining",
+	})
+	if err != nil {
+		log.Printf("Failed to send draining message: %v", err)
+		return
+	}
+	if _, err := message.Receive[message.Ack](acks, ctx); err != nil {
+		log.Printf("Failed to read draining ack: %v", err)
+		return
+	}
+
+	log.Printf("Draining, waiting for requests in progress to complete")
+	if reqs.wait(ctx) {
+		log.Printf("Drained")
+	} else {
+		log.Printf("Drain timeout reached, disconnecting with requests in progress")
+	}
+}
+
+// serveRequests handles requests from the hub until the connection is lost or
+// ctx is cancelled. Requests in progress are cancelled when it returns, as the
+// hub has given up on them once the connection is gone and their replies could
+// no longer be delivered anyway.
+func serveRequests(mb *message.MessageBuffer, be backend, reqs *inflight, ctx context.Context) error {
+	// Stop serving once the hub announces it is shutting down
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	shutdowns := mb.SubscribeType(message.MTServerShutdown)
+	defer shutdowns.Close()
+	go func() {
+		if _, err := message.Receive[string](shutdowns, ctx); err == nil {
+			cancel(errHubShutdown)
+		}
+	}()
+
 	// Ping message handler
+	pings := mb.SubscribeType(message.MTPing)
+	defer pings.Close()
 	go func() {
 		for {
-			ping, err := message.ReceiveType[string](mb, message.MTPing, ctx)
+			ping, err := message.Receive[string](pings, ctx)
 			if err != nil {
 				log.Printf("failed to read ping: %v", err)
 				return
@@ -71,19 +217,63 @@ func initWebsocket(opts *AgentOpts, done chan struct{}, mb *message.MessageBuffe
 		}
 	}()
 
-	// Wait for completions request
+	// Requests and cancellations are handled in the order they arrive, so
+	// that a cancel is never processed before the request it is for
+	msgs := mb.SubscribeType(
+		message.MTCompletionsRequest,
+		message.MTChatCompletionsRequest,
+		message.MTEmbeddingsRequest,
+		message.MTCancel,
+	)
+	defer msgs.Close()
 	for {
-		req, err := message.ReceiveType[message.CompletionsRequest](mb, message.MTCompletionsRequest, ctx)
+		msg, err := message.Receive[json.RawMessage](msgs, ctx)
 		if err != nil {
-			log.Printf("failed to read completions request: %v", err)
-			return
+			if cause := context.Cause(ctx); errors.Is(cause, errHubShutdown) {
+				return cause
+			}
+			return fmt.Errorf("failed to read request: %w", err)
+		}
+
+		if msg.Type == message.MTCancel {
+			if reqs.cancel(msg.Id) {
+				log.Printf("Cancelling request %s", msg.Id)
+			}
+			continue
 		}
-		log.Printf("Received completions request %s", req.Id)
+		log.Printf("Received %s %s", msg.Type, msg.Id)
 
-		go func(req message.TypedMessage[message.CompletionsRequest]) {
-			handleCompletions(opts, &req, client, mb)
-			log.Printf("Completed request %s", req.Id)
-		}(*req)
+		hctx, done := reqs.start(msg.Id, ctx)
+		go func() {
+			defer done()
+			serveRequest(be, msg, mb, hctx)
+			log.Printf("Completed request %s", msg.Id)
+		}()
 	}
+}
 
+// serveRequest decodes a request from the hub and passes it to the backend.
+func serveRequest(be backend, msg *message.TypedMessage[json.RawMessage], mb *message.MessageBuffer, ctx context.Context) {
+	var err error
+	switch msg.Type {
+	case message.MTCompletionsRequest:
+		var req message.CompletionsRequest
+		if err = json.Unmarshal(msg.Message, &req); err == nil {
+			be.completions(msg.Id, req, mb, ctx)
+		}
+	case message.MTChatCompletionsRequest:
+		var req message.ChatCompletionsRequest
+		if err = json.Unmarshal(msg.Message, &req); err == nil {
+			be.chatCompletions(msg.Id, req, mb, ctx)
+		}
+	case message.MTEmbeddingsRequest:
+		var req message.EmbeddingsRequest
+		if err = json.Unmarshal(msg.Message, &req); err == nil {
+			be.embeddings(msg.Id, req, mb, ctx)
+		}
+	}
+	if err != nil {
+		log.Printf("failed to decode %s: %v", msg.Type, err)
+		sendError(mb, msg.Id, http.StatusBadRequest, "invalid_request_error", "failed to decode request")
+	}
 }
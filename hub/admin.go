@@ -0,0 +1,228 @@
+package hub
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// workerStatus is the view of a worker exposed by the admin API.
+type workerStatus struct {
+	Id             uuid.UUID `json:"id"`
+	Name           string    `json:"name"`
+	Models         []string  `json:"models"`
+	MaxConcurrency int       `json:"max_concurrency"`
+	Draining       bool      `json:"draining"`
+	Weight         float64   `json:"weight"`
+	ActiveTasks    int       `json:"active_tasks"`
+	TotalRequests  uint64    `json:"total_requests"`
+	ConnectedAt    time.Time `json:"connected_at"`
+	PingRTTMs      float64   `json:"ping_rtt_ms"`
+
+	// Moving averages used by the latency routing policy
+	TimeToFirstTokenMs float64 `json:"ttft_ms"`
+	TokensPerSecond    float64 `json:"tokens_per_second"`
+	ErrorRate          float64 `json:"error_rate"`
+}
+
+func newWorkerStatus(w *Worker) workerStatus {
+	info := w.GetInfo()
+	latency := w.GetLatencyStats()
+	models := make([]string, 0, len(info.AvailableModels))
+	for _, model := range info.AvailableModels {
+		models = append(models, model.Id)
+	}
+
+	return workerStatus{
+		Id:             w.Id,
+		Name:           info.WorkerName,
+		Models:         models,
+		MaxConcurrency: info.MaxConcurrency,
+		Draining:       w.IsDraining(),
+		Weight:         w.GetWeight(),
+		ActiveTasks:    w.GetActiveTasks(),
+		TotalRequests:  w.GetTotalTasks(),
+		ConnectedAt:    w.connectedAt,
+		PingRTTMs:      float64(w.GetPingRTT().Microseconds()) / 1000,
+
+		TimeToFirstTokenMs: float64(latency.TimeToFirstToken.Microseconds()) / 1000,
+		TokensPerSecond:    latency.TokensPerSecond,
+		ErrorRate:          latency.ErrorRate,
+	}
+}
+
+// isBanned reports whether workers with the given name may not register.
+func (h *Hub) isBanned(name string) bool {
+	h.bansLock.Lock()
+	defer h.bansLock.Unlock()
+	return h.bannedWorkers[name]
+}
+
+// findWorkers returns the workers matching the id or name.
+func (h *Hub) findWorkers(idOrName string) []*Worker {
+	id, err := uuid.Parse(idOrName)
+	matches := make([]*Worker, 0)
+	for _, worker := range h.GetWorkers() {
+		if (err == nil && worker.Id == id) || worker.GetInfo().WorkerName == idOrName {
+			matches = append(matches, worker)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].connectedAt.Before(matches[j].connectedAt)
+	})
+	return matches
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// adminHandler wraps a handler acting on the workers matching the {worker}
+// path parameter, authenticating the request and responding with the status
+// of the workers afterwards.
+func (h *Hub) adminHandler(action func(w http.ResponseWriter, r *http.Request, workers []*Worker) bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !h.authenticateAdmin(w, r) {
+			return
+		}
+
+		workers := h.findWorkers(r.PathValue("worker"))
+		if len(workers) == 0 {
+			writeError(w, http.StatusNotFound, "invalid_request_error", "worker_not_found",
+				fmt.Sprintf("No worker with id or name '%s'.", r.PathValue("worker")))
+			return
+		}
+		if !action(w, r, workers) {
+			return
+		}
+
+		statuses := make([]workerStatus, 0, len(workers))
+		for _, worker := range workers {
+			statuses = append(statuses, newWorkerStatus(worker))
+		}
+		writeJSON(w, statuses)
+	}
+}
+
+// registerAdminRoutes adds the admin API used to manage workers to the mux.
+func (h *Hub) registerAdminRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /admin/v1/workers", func(w http.ResponseWriter, r *http.Request) {
+		if !h.authenticateAdmin(w, r) {
+			return
+		}
+
+		workers := h.GetWorkers()
+		sort.Slice(workers, func(i, j int) bool {
+			return workers[i].connectedAt.Before(workers[j].connectedAt)
+		})
+		statuses := make([]workerStatus, 0, len(workers))
+		for _, worker := range workers {
+			statuses = append(statuses, newWorkerStatus(worker))
+		}
+		writeJSON(w, statuses)
+	})
+
+	mux.HandleFunc("GET /admin/v1/workers/{worker}", h.adminHandler(
+		func(w http.ResponseWriter, r *http.Request, workers []*Worker) bool {
+			return true
+		}))
+
+	mux.HandleFunc("POST /admin/v1/workers/{worker}/drain", h.adminHandler(
+		func(w http.ResponseWriter, r *http.Request, workers []*Worker) bool {
+			for _, worker := range workers {
+				worker.setDraining(true)
+				log.Printf("Draining worker %v", worker.Id)
+			}
+			return true
+		}))
+
+	mux.HandleFunc("POST /admin/v1/workers/{worker}/undrain", h.adminHandler(
+		func(w http.ResponseWriter, r *http.Request, workers []*Worker) bool {
+			for _, worker := range workers {
+				worker.setDraining(false)
+				log.Printf("Undraining worker %v", worker.Id)
+			}
+			h.queue.wakeAll()
+			return true
+		}))
+
+	mux.HandleFunc("POST /admin/v1/workers/{worker}/disconnect", h.adminHandler(
+		func(w http.ResponseWriter, r *http.Request, workers []*Worker) bool {
+			for _, worker := range workers {
+				h.UnregisterWorker(worker.Id)
+			}
+			return true
+		}))
+
+	mux.HandleFunc("POST /admin/v1/workers/{worker}/ban", h.adminHandler(
+		func(w http.ResponseWriter, r *http.Request, workers []*Worker) bool {
+			// Ban by name, since ids change when workers reconnect
+			for _, worker := range workers {
+				name := worker.GetInfo().WorkerName
+				h.bansLock.Lock()
+				h.bannedWorkers[name] = true
+				h.bansLock.Unlock()
+
+				log.Printf("Banning worker %q", name)
+				for _, other := range h.findWorkers(name) {
+					h.UnregisterWorker(other.Id)
+				}
+			}
+			return true
+		}))
+
+	mux.HandleFunc("PUT /admin/v1/workers/{worker}/weight", h.adminHandler(
+		func(w http.ResponseWriter, r *http.Request, workers []*Worker) bool {
+			var req struct {
+				Weight float64 `json:"weight"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Weight <= 0 {
+				writeError(w, http.StatusBadRequest, "invalid_request_error", "invalid_weight",
+					"The weight must be a positive number.")
+				return false
+			}
+
+			for _, worker := range workers {
+				worker.setWeight(req.Weight)
+				log.Printf("Set weight of worker %v to %v", worker.Id, req.Weight)
+			}
+			return true
+		}))
+
+	mux.HandleFunc("GET /admin/v1/bans", func(w http.ResponseWriter, r *http.Request) {
+		if !h.authenticateAdmin(w, r) {
+			return
+		}
+
+		h.bansLock.Lock()
+		names := sortedKeys(h.bannedWorkers)
+		h.bansLock.Unlock()
+		writeJSON(w, names)
+	})
+
+	mux.HandleFunc("DELETE /admin/v1/bans/{name}", func(w http.ResponseWriter, r *http.Request) {
+		if !h.authenticateAdmin(w, r) {
+			return
+		}
+
+		name := r.PathValue("name")
+		h.bansLock.Lock()
+		banned := h.bannedWorkers[name]
+		delete(h.bannedWorkers, name)
+		h.bansLock.Unlock()
+
+		if !banned {
+			writeError(w, http.StatusNotFound, "invalid_request_error", "ban_not_found",
+				fmt.Sprintf("No ban for worker '%s'.", name))
+			return
+		}
+		log.Printf("Unbanned worker %q", name)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
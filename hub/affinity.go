@@ -0,0 +1,120 @@
+package hub
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/hizkifw/lmrouter/message"
+)
+
+// affinityReplicas is the number of points each worker has on the hash ring.
+const affinityReplicas = 64
+
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// affinityKey returns the key used to send related requests to the same
+// worker, so that it can reuse its KV cache. It is the session header if set,
+// then the user of the request, then a prefix of the prompt if prefix hashing
+// is enabled. An empty key is returned if affinity routing is disabled or the
+// request has no key.
+func (h *Hub) affinityKey(r *http.Request, user string, prompt string) string {
+	if h.affinityPrefix <= 0 && h.affinityHeader == "" {
+		return ""
+	}
+	if session := r.Header.Get(h.affinityHeader); h.affinityHeader != "" && session != "" {
+		return "session:" + session
+	}
+	if user != "" {
+		return "user:" + user
+	}
+	if h.affinityPrefix <= 0 {
+		return ""
+	}
+	if len(prompt) > h.affinityPrefix {
+		prompt = prompt[:h.affinityPrefix]
+	}
+	return "prompt:" + prompt
+}
+
+// chatPrefix returns the part of a conversation that stays the same across
+// turns, up to and including the first user message.
+func chatPrefix(messages []message.ChatMessage) string {
+	for i, msg := range messages {
+		if msg.Role == "user" {
+			messages = messages[:i+1]
+			break
+		}
+	}
+	prefix, _ := json.Marshal(messages)
+	return string(prefix)
+}
+
+// affinityWorker picks the worker for the key by consistent hashing, so that
+// most keys keep their worker when workers come and go.
+func affinityWorker(key string, workers []*Worker) *Worker {
+	if len(workers) == 0 {
+		return nil
+	}
+
+	// Place workers on the ring by name, which survives reconnects, falling
+	// back to the id for workers sharing a name
+	sort.Slice(workers, func(i, j int) bool {
+		return workers[i].connectedAt.Before(workers[j].connectedAt)
+	})
+	type point struct {
+		hash   uint64
+		worker *Worker
+	}
+	ring := make([]point, 0, len(workers)*affinityReplicas)
+	names := make(map[string]bool, len(workers))
+	for _, w := range workers {
+		name := w.GetInfo().WorkerName
+		if names[name] {
+			name += "/" + w.Id.String()
+		}
+		names[name] = true
+
+		for i := 0; i < affinityReplicas; i++ {
+			ring = append(ring, point{hashKey(name + "#" + strconv.Itoa(i)), w})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		return ring[i].hash < ring[j].hash
+	})
+
+	hash := hashKey(key)
+	i := sort.Search(len(ring), func(i int) bool {
+		return ring[i].hash >= hash
+	})
+	if i == len(ring) {
+		i = 0
+	}
+	return ring[i].worker
+}
+
+// affinityBusy reports whether the affinity worker is too busy to be preferred,
+// because it is full, or because it already has a full slot's worth of work
+// while another candidate is less loaded. The latter matters for workers that
+// did not advertise their slots, which never run out of capacity.
+func affinityBusy(worker *Worker, candidates []*Worker) bool {
+	if !worker.HasCapacity() {
+		return true
+	}
+	load := worker.Load()
+	if load < 1 {
+		return false
+	}
+	for _, c := range candidates {
+		if c.Load() < load {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+package hub
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/hizkifw/lmrouter/message"
+)
+
+// modelPattern matches the model ids advertised by workers. It is either an
+// exact id, a glob pattern, or a regular expression enclosed in slashes.
+type modelPattern struct {
+	glob string
+	re   *regexp.Regexp
+}
+
+func compileModelPattern(pattern string) (modelPattern, error) {
+	if len(pattern) >= 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return modelPattern{}, fmt.Errorf("invalid regular expression %q: %w", pattern, err)
+		}
+		return modelPattern{re: re}, nil
+	}
+
+	if _, err := path.Match(pattern, ""); err != nil {
+		return modelPattern{}, fmt.Errorf("invalid glob pattern %q: %w", pattern, err)
+	}
+	return modelPattern{glob: pattern}, nil
+}
+
+func (p modelPattern) match(model string) bool {
+	if p.re != nil {
+		return p.re.MatchString(model)
+	}
+	ok, _ := path.Match(p.glob, model)
+	return ok
+}
+
+// compileAliases compiles the model patterns of the configured aliases.
+func compileAliases(aliases []ModelAlias) (map[string][]modelPattern, error) {
+	compiled := make(map[string][]modelPattern, len(aliases))
+	for _, alias := range aliases {
+		if alias.Alias == "" {
+			return nil, fmt.Errorf("model alias has no name")
+		}
+		if len(alias.Models) == 0 {
+			return nil, fmt.Errorf("model alias %q has no models", alias.Alias)
+		}
+		if _, ok := compiled[alias.Alias]; ok {
+			return nil, fmt.Errorf("model alias %q is defined more than once", alias.Alias)
+		}
+
+		patterns := make([]modelPattern, 0, len(alias.Models))
+		for _, model := range alias.Models {
+			pattern, err := compileModelPattern(model)
+			if err != nil {
+				return nil, fmt.Errorf("model alias %q: %w", alias.Alias, err)
+			}
+			patterns = append(patterns, pattern)
+		}
+		compiled[alias.Alias] = patterns
+	}
+	return compiled, nil
+}
+
+// workerModel returns the id of the model to request from the worker in order
+// to serve the requested model, which may be an alias. Models the worker
+// serves under the requested name take precedence over aliases, then the
+// alias targets are tried in order. Embedding-only models are skipped unless
+// embeddings are requested.
+func (h *Hub) workerModel(w *Worker, model string, embeddings bool) (string, bool) {
+	available := make([]message.Model, 0)
+	for _, m := range w.GetInfo().AvailableModels {
+		if embeddings || !m.EmbeddingsOnly {
+			available = append(available, m)
+		}
+	}
+
+	for _, m := range available {
+		if m.Id == model {
+			return model, true
+		}
+	}
+	for _, pattern := range h.aliases[model] {
+		for _, m := range available {
+			if pattern.match(m.Id) {
+				return m.Id, true
+			}
+		}
+	}
+	return "", false
+}
+
+// aliasModels returns the aliases that resolve to a model currently served by
+// a worker, in the format of the list models endpoint.
+func (h *Hub) aliasModels() []message.Model {
+	models := make([]message.Model, 0)
+	for _, alias := range sortedKeys(h.aliases) {
+		if h.servesModel(alias) {
+			models = append(models, message.Model{
+				Id:      alias,
+				Object:  "model",
+				OwnedBy: "lmrouter",
+			})
+		}
+	}
+	return models
+}
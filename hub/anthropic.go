@@ -0,0 +1,272 @@
+package hub
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/hizkifw/lmrouter/message"
+)
+
+// anthropicChatRequest translates an Anthropic Messages API request into the
+// chat completions request sent to workers. Only text content is supported.
+func anthropicChatRequest(req message.AnthropicMessagesRequest) (message.ChatCompletionsRequest, error) {
+	chatReq := message.ChatCompletionsRequest{
+		Model:       req.Model,
+		Messages:    make([]message.ChatMessage, 0, len(req.Messages)+1),
+		Stream:      req.Stream,
+		Temperature: req.Temperature,
+		TopP:        req.TopP,
+	}
+	if req.MaxTokens > 0 {
+		chatReq.MaxTokens = &req.MaxTokens
+	}
+	if len(req.StopSequences) > 0 {
+		var stop interface{} = req.StopSequences
+		chatReq.Stop = &stop
+	}
+	if req.Metadata != nil {
+		chatReq.User = req.Metadata.UserId
+	}
+
+	if req.System != nil {
+		system, err := anthropicText(req.System)
+		if err != nil {
+			return chatReq, fmt.Errorf("system: %w", err)
+		}
+		chatReq.Messages = append(chatReq.Messages, message.ChatMessage{Role: "system", Content: system})
+	}
+	for i, m := range req.Messages {
+		if m.Role != "user" && m.Role != "assistant" {
+			return chatReq, fmt.Errorf("messages.%d: unexpected role %q", i, m.Role)
+		}
+		text, err := anthropicText(m.Content)
+		if err != nil {
+			return chatReq, fmt.Errorf("messages.%d: %w", i, err)
+		}
+		chatReq.Messages = append(chatReq.Messages, message.ChatMessage{Role: m.Role, Content: text})
+	}
+
+	return chatReq, nil
+}
+
+// anthropicText returns the text of Anthropic message content, which is
+// either a string or a list of content blocks.
+func anthropicText(content interface{}) (string, error) {
+	switch c := content.(type) {
+	case string:
+		return c, nil
+	case []interface{}:
+		var text strings.Builder
+		for _, block := range c {
+			b, _ := block.(map[string]interface{})
+			if b["type"] != "text" {
+				return "", fmt.Errorf("unsupported content block type %v", b["type"])
+			}
+			s, _ := b["text"].(string)
+			text.WriteString(s)
+		}
+		return text.String(), nil
+	default:
+		return "", fmt.Errorf("content must be a string or a list of content blocks")
+	}
+}
+
+// anthropicStopReason maps an OpenAI finish reason to an Anthropic stop reason.
+func anthropicStopReason(finishReason string) string {
+	switch finishReason {
+	case "length":
+		return "max_tokens"
+	case "tool_calls", "function_call":
+		return "tool_use"
+	default:
+		return "end_turn"
+	}
+}
+
+// anthropicErrorType maps an HTTP status code to an Anthropic error type.
+func anthropicErrorType(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return "invalid_request_error"
+	case http.StatusUnauthorized:
+		return "authentication_error"
+	case http.StatusForbidden:
+		return "permission_error"
+	case http.StatusNotFound:
+		return "not_found_error"
+	case http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case http.StatusServiceUnavailable:
+		return "overloaded_error"
+	default:
+		return "api_error"
+	}
+}
+
+// anthropicError converts an error body written by the hub or relayed from a
+// worker, either an OpenAI error or plain text, into an Anthropic error.
+func anthropicError(status int, body []byte) message.AnthropicErrorResponse {
+	return message.AnthropicErrorResponse{
+		Type: "error",
+		Error: message.AnthropicErrorDetail{
+			Type:    anthropicErrorType(status),
+			Message: errorMessage(status, body),
+		},
+	}
+}
+
+// anthropicWriter translates the OpenAI chat completions responses and errors
+// written to it into the Anthropic Messages API format.
+type anthropicWriter struct {
+	*translatingWriter
+
+	// State of the stream being translated
+	started      bool
+	failed       bool
+	stopReason   string
+	inputTokens  int
+	outputTokens int
+}
+
+func newAnthropicWriter(w http.ResponseWriter) *anthropicWriter {
+	aw := &anthropicWriter{}
+	aw.translatingWriter = newTranslatingWriter(w, aw.translateEvent)
+	return aw
+}
+
+// writeEvent sends an Anthropic SSE event to the client.
+func (w *anthropicWriter) writeEvent(typ string, data map[string]any) {
+	data["type"] = typ
+	enc, _ := json.Marshal(data)
+	fmt.Fprintf(w.ResponseWriter, "event: %s\ndata: %s\n\n", typ, enc)
+	w.Flush()
+}
+
+// start sends the events opening the message and its text content block.
+func (w *anthropicWriter) start(id string, model string) {
+	w.started = true
+	w.writeEvent("message_start", map[string]any{
+		"message": message.AnthropicMessagesResponse{
+			Id:      id,
+			Type:    "message",
+			Role:    "assistant",
+			Content: []message.AnthropicContentBlock{},
+			Model:   model,
+			Usage:   message.AnthropicUsage{InputTokens: w.inputTokens},
+		},
+	})
+	w.writeEvent("content_block_start", map[string]any{
+		"index":         0,
+		"content_block": message.AnthropicContentBlock{Type: "text"},
+	})
+}
+
+// translateEvent converts an OpenAI SSE event into Anthropic events.
+func (w *anthropicWriter) translateEvent(data []byte, isError bool) {
+	if isError {
+		var compErr message.ErrorResponse
+		json.Unmarshal(data, &compErr)
+		w.failed = true
+		w.writeEvent("error", map[string]any{
+			"error": message.AnthropicErrorDetail{Type: "api_error", Message: compErr.Error.Message},
+		})
+		return
+	}
+
+	var chunk message.ChatCompletionsResponse
+	if err := json.Unmarshal(data, &chunk); err != nil {
+		return
+	}
+	if chunk.Usage != nil {
+		w.inputTokens = chunk.Usage.PromptTokens
+		w.outputTokens = chunk.Usage.CompletionTokens
+	} else {
+		// Estimate one token per chunk if the worker does not report usage
+		w.outputTokens++
+	}
+	if !w.started {
+		w.start(chunk.ID, chunk.Model)
+	}
+	for _, choice := range chunk.Choices {
+		if choice.Index != 0 {
+			continue
+		}
+		if choice.Delta != nil {
+			if text, _ := choice.Delta.Content.(string); text != "" {
+				w.writeEvent("content_block_delta", map[string]any{
+					"index": 0,
+					"delta": map[string]any{"type": "text_delta", "text": text},
+				})
+			}
+		}
+		if choice.FinishReason != nil {
+			w.stopReason = anthropicStopReason(*choice.FinishReason)
+		}
+	}
+}
+
+// finish writes the translated response once the request has been served.
+func (w *anthropicWriter) finish() {
+	switch {
+	case w.status == 0:
+		// Nothing was written, the client went away
+		return
+
+	case w.status != http.StatusOK:
+		w.Header().Set("Content-Type", "application/json")
+		w.ResponseWriter.WriteHeader(w.status)
+		json.NewEncoder(w.ResponseWriter).Encode(anthropicError(w.status, w.buf.Bytes()))
+
+	case !w.stream:
+		var resp message.ChatCompletionsResponse
+		if err := json.Unmarshal(w.buf.Bytes(), &resp); err != nil || len(resp.Choices) == 0 {
+			w.Header().Set("Content-Type", "application/json")
+			w.ResponseWriter.WriteHeader(http.StatusBadGateway)
+			json.NewEncoder(w.ResponseWriter).Encode(anthropicError(http.StatusBadGateway,
+				[]byte("Failed to parse response from worker")))
+			return
+		}
+
+		text := ""
+		stopReason := "end_turn"
+		choice := resp.Choices[0]
+		if choice.Message != nil {
+			text, _ = choice.Message.Content.(string)
+		}
+		if choice.FinishReason != nil {
+			stopReason = anthropicStopReason(*choice.FinishReason)
+		}
+		msg := message.AnthropicMessagesResponse{
+			Id:         resp.ID,
+			Type:       "message",
+			Role:       "assistant",
+			Content:    []message.AnthropicContentBlock{{Type: "text", Text: text}},
+			Model:      resp.Model,
+			StopReason: &stopReason,
+		}
+		if resp.Usage != nil {
+			msg.Usage.InputTokens = resp.Usage.PromptTokens
+			msg.Usage.OutputTokens = resp.Usage.CompletionTokens
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.ResponseWriter.WriteHeader(http.StatusOK)
+		json.NewEncoder(w.ResponseWriter).Encode(msg)
+
+	case !w.failed:
+		// Close the content block and the message
+		if !w.started {
+			w.start("", "")
+		}
+		if w.stopReason == "" {
+			w.stopReason = "end_turn"
+		}
+		w.writeEvent("content_block_stop", map[string]any{"index": 0})
+		w.writeEvent("message_delta", map[string]any{
+			"delta": map[string]any{"stop_reason": w.stopReason, "stop_sequence": nil},
+			"usage": map[string]any{"output_tokens": w.outputTokens},
+		})
+		w.writeEvent("message_stop", map[string]any{})
+	}
+}
@@ -0,0 +1,130 @@
+package hub
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// loadTokens reads tokens from a file, one per line. Blank lines and lines
+// starting with # are ignored.
+func loadTokens(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open token file: %w", err)
+	}
+	defer f.Close()
+
+	tokens := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		tokens = append(tokens, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read token file: %w", err)
+	}
+
+	return tokens, nil
+}
+
+// checkWorkerToken reports whether the token may be used to register a worker.
+// If no tokens are configured, any worker is allowed to register.
+func (h *Hub) checkWorkerToken(token string) bool {
+	if len(h.workerTokens) == 0 {
+		return true
+	}
+
+	ok := false
+	for _, t := range h.workerTokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
+
+// authenticateAdmin checks the bearer token of the request against the admin
+// tokens and writes an error response if it is missing or invalid.
+func (h *Hub) authenticateAdmin(w http.ResponseWriter, r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		writeError(w, http.StatusUnauthorized, "invalid_request_error", "missing_admin_token",
+			"You didn't provide an admin token. Provide it in the Authorization header using Bearer auth.")
+		return false
+	}
+
+	valid := false
+	for _, t := range h.adminTokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(strings.TrimSpace(token))) == 1 {
+			valid = true
+		}
+	}
+	if !valid {
+		writeError(w, http.StatusUnauthorized, "invalid_request_error", "invalid_admin_token",
+			"Incorrect admin token provided.")
+		return false
+	}
+
+	return true
+}
+
+// AllowsModel reports whether the key may be used with the given model. A nil
+// key, used when API keys are disabled, allows every model.
+func (k *ApiKey) AllowsModel(model string) bool {
+	if k == nil || len(k.Models) == 0 {
+		return true
+	}
+	for _, m := range k.Models {
+		if m == model {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate checks the bearer token of the request, or its X-Api-Key header
+// as sent by Anthropic clients, against the configured API keys and writes an
+// error response if it is missing or invalid. It returns a nil key if API keys
+// are disabled.
+func (h *Hub) authenticate(w http.ResponseWriter, r *http.Request) (*ApiKey, bool) {
+	if len(h.apiKeys) == 0 {
+		return nil, true
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		token = r.Header.Get("X-Api-Key")
+	}
+	if token == "" {
+		writeError(w, http.StatusUnauthorized, "invalid_request_error", "missing_api_key",
+			"You didn't provide an API key. Provide it in the Authorization header using Bearer auth.")
+		return nil, false
+	}
+
+	key, ok := h.apiKeys[strings.TrimSpace(token)]
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "invalid_request_error", "invalid_api_key",
+			"Incorrect API key provided.")
+		return nil, false
+	}
+
+	return key, true
+}
+
+// authorizeModel writes an error response if the key may not use the model.
+func authorizeModel(w http.ResponseWriter, key *ApiKey, model string) bool {
+	if key.AllowsModel(model) {
+		return true
+	}
+
+	writeError(w, http.StatusForbidden, "invalid_request_error", "model_not_allowed",
+		fmt.Sprintf("The API key does not have access to model '%s'.", model))
+	return false
+}
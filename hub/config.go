@@ -0,0 +1,79 @@
+package hub
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Config is the hub configuration loaded from the file given by --config.
+type Config struct {
+	// ApiKeys are the keys clients can use to access the API. If empty, the
+	// API is open to everyone.
+	ApiKeys []ApiKey `json:"api_keys"`
+
+	// RateLimit is the default rate limit applied to each API key, or to
+	// each client IP if API keys are disabled
+	RateLimit *RateLimit `json:"rate_limit,omitempty"`
+
+	// TrustProxy makes the hub identify clients by the X-Forwarded-For header
+	TrustProxy bool `json:"trust_proxy,omitempty"`
+
+	// Aliases are alternative names clients can request models by
+	Aliases []ModelAlias `json:"aliases,omitempty"`
+
+	// Fallbacks are the models to serve a request with, in order, when the
+	// requested model has no worker available
+	Fallbacks map[string][]string `json:"fallbacks,omitempty"`
+}
+
+// ModelAlias maps a model name requested by clients to the models advertised
+// by workers.
+type ModelAlias struct {
+	// Alias is the model name requested by clients
+	Alias string `json:"alias"`
+
+	// Models are the model ids to serve the alias with, in order of
+	// preference. Each can be an exact id, a glob pattern like
+	// "Mistral-7B-*", or a regular expression enclosed in slashes.
+	Models []string `json:"models"`
+}
+
+// ApiKey is a bearer token a client can use to access the API.
+type ApiKey struct {
+	// Key is the bearer token
+	Key string `json:"key"`
+
+	// Name identifies the key owner in logs
+	Name string `json:"name"`
+
+	// Models limits the key to the given models. If empty, all models are
+	// allowed.
+	Models []string `json:"models,omitempty"`
+
+	// RateLimit overrides the default rate limit for this key
+	RateLimit *RateLimit `json:"rate_limit,omitempty"`
+}
+
+func loadConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer f.Close()
+
+	var config Config
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&config); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+
+	for i, key := range config.ApiKeys {
+		if key.Key == "" {
+			return nil, fmt.Errorf("api key %d (%q) has no key", i, key.Name)
+		}
+	}
+
+	return &config, nil
+}
@@ -0,0 +1,27 @@
+package hub
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/hizkifw/lmrouter/message"
+)
+
+// writeError writes an error response in the OpenAI error format, so that
+// client SDKs can surface it properly.
+func writeError(w http.ResponseWriter, statusCode int, typ string, code string, msg string) {
+	var errCode *string
+	if code != "" {
+		errCode = &code
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(message.ErrorResponse{
+		Error: message.ErrorDetail{
+			Message: msg,
+			Type:    typ,
+			Code:    errCode,
+		},
+	})
+}
@@ -2,10 +2,10 @@ package hub
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"strings"
 	"sync"
 	"time"
 
@@ -13,9 +13,66 @@ import (
 	"github.com/hizkifw/lmrouter/message"
 )
 
+// servedModelHeader is the response header telling clients which model served
+// their request, which differs from the requested one after a fallback.
+const servedModelHeader = "X-Served-Model"
+
+// pingTimeout is how long a worker has to reply to a ping before it is
+// considered dead.
+const pingTimeout = 10 * time.Second
+
 type Hub struct {
 	workers     map[uuid.UUID]*Worker
 	workersLock sync.Mutex
+
+	// workerTokens are the tokens accepted for worker registration
+	workerTokens []string
+
+	// adminTokens are the tokens accepted for the admin API
+	adminTokens []string
+
+	// bannedWorkers are the names of workers that may not register
+	bannedWorkers map[string]bool
+	bansLock      sync.Mutex
+
+	// aliases are the model patterns each model alias resolves to
+	aliases map[string][]modelPattern
+
+	// apiKeys are the keys accepted for client requests, by token
+	apiKeys map[string]*ApiKey
+
+	// rateLimit is the default rate limit for each client
+	rateLimit   *RateLimit
+	rateLimiter *rateLimiter
+	trustProxy  bool
+
+	// routing picks which worker serves each request
+	routing routingPolicy
+
+	// affinityPrefix is the length of the prompt prefix hashed to pick a
+	// worker for related requests, or 0 to disable prefix hashing, and
+	// affinityHeader the request header identifying a session. Affinity
+	// routing is disabled if neither is set.
+	affinityPrefix int
+	affinityHeader string
+
+	// queue holds requests waiting for a worker for up to queueTimeout
+	queue        *requestQueue
+	queueTimeout time.Duration
+
+	// fallbacks are the models to try in order when a model has no worker
+	// available within fallbackAfter
+	fallbacks     map[string][]string
+	fallbackAfter time.Duration
+
+	metrics *metrics
+
+	// shuttingDown is set once the hub stops accepting requests, and
+	// idle is closed when the last request in progress completes
+	shuttingDown   bool
+	activeRequests int
+	idle           chan struct{}
+	shutdownLock   sync.Mutex
 }
 
 func (h *Hub) GetWorkers() []*Worker {
@@ -30,12 +87,23 @@ func (h *Hub) GetWorkers() []*Worker {
 	return workerList
 }
 
+// servesModel reports whether any connected worker serves the model, either
+// directly or through an alias.
+func (h *Hub) servesModel(model string) bool {
+	for _, worker := range h.GetWorkers() {
+		if _, ok := h.workerModel(worker, model, true); ok {
+			return true
+		}
+	}
+	return false
+}
+
 func (h *Hub) GetAllModels() []message.Model {
 	workersList := h.GetWorkers()
 	models := make([]message.Model, 0)
 	inserted := make(map[string]bool)
 	for _, worker := range workersList {
-		for _, model := range worker.Info.AvailableModels {
+		for _, model := range worker.GetInfo().AvailableModels {
 			key := fmt.Sprintf("%s/%s", model.OwnedBy, model.Id)
 			if _, ok := inserted[key]; !ok {
 				models = append(models, model)
@@ -47,22 +115,31 @@ func (h *Hub) GetAllModels() []message.Model {
 
 }
 
-func (h *Hub) PingLoop() {
-	for {
+func (h *Hub) PingLoop(ctx context.Context) {
+	for ctx.Err() == nil {
 		workersList := h.GetWorkers()
 		for _, worker := range workersList {
-			id, err := message.Send[string](worker.mbuf, &message.TypedMessage[string]{
+			// Subscribe to the reply before sending the ping so it is not missed
+			id := message.NewId()
+			sub := worker.mbuf.SubscribeId(id)
+			start := time.Now()
+			_, err := message.Send[string](worker.mbuf, &message.TypedMessage[string]{
 				Type:    message.MTPing,
+				Id:      id,
 				Message: "ping",
 			})
 			if err != nil {
+				sub.Close()
 				log.Printf("Failed to send ping to worker %v: %v", worker.Id, err)
 				worker.conn.Close()
 				h.UnregisterWorker(worker.Id)
 				continue
 			}
 
-			reply, err := message.ReceiveId[string](worker.mbuf, id, context.Background())
+			pingCtx, cancel := context.WithTimeout(ctx, pingTimeout)
+			reply, err := message.Receive[string](sub, pingCtx)
+			cancel()
+			sub.Close()
 			if err != nil {
 				log.Printf("Failed to receive ping reply from worker %v: %v", worker.Id, err)
 				worker.conn.Close()
@@ -76,9 +153,16 @@ func (h *Hub) PingLoop() {
 				h.UnregisterWorker(worker.Id)
 				continue
 			}
+
+			rtt := time.Since(start)
+			worker.setPingRTT(rtt)
+			h.metrics.observePing(worker, rtt)
 		}
 
-		time.Sleep(5 * time.Second)
+		select {
+		case <-time.After(5 * time.Second):
+		case <-ctx.Done():
+		}
 	}
 }
 
@@ -86,13 +170,26 @@ func (h *Hub) RegisterWorker(worker *Worker) {
 	h.workersLock.Lock()
 	defer h.workersLock.Unlock()
 	h.workers[worker.Id] = worker
+	defer h.queue.wakeAll()
 	worker.conn.SetCloseHandler(func(code int, text string) error {
 		h.UnregisterWorker(worker.Id)
 		return nil
 	})
+	go func() {
+		// Also catch connections that drop without a close frame
+		<-worker.mbuf.Done()
+		h.UnregisterWorker(worker.Id)
+	}()
 	log.Printf("Registered worker %v", worker.Id)
 }
 
+// CloseWorkers disconnects all workers from the hub.
+func (h *Hub) CloseWorkers() {
+	for _, worker := range h.GetWorkers() {
+		h.UnregisterWorker(worker.Id)
+	}
+}
+
 func (h *Hub) UnregisterWorker(id uuid.UUID) {
 	h.workersLock.Lock()
 	defer h.workersLock.Unlock()
@@ -105,44 +202,133 @@ func (h *Hub) UnregisterWorker(id uuid.UUID) {
 	}
 }
 
-func (h *Hub) RequestCompletions(req message.CompletionsRequest, w http.ResponseWriter, ctx context.Context) {
-	if len(h.workers) == 0 {
-		http.Error(w, "No workers available", http.StatusServiceUnavailable)
-		return
+func (h *Hub) RequestCompletions(req message.CompletionsRequest, key *ApiKey, affinity string, w http.ResponseWriter, ctx context.Context) RequestStats {
+	rt := route{model: req.Model, key: key, affinity: affinity}
+	return h.dispatch(rt, w, ctx, func(worker *Worker, served string, model string) (RequestStats, error) {
+		req.Model = model
+		return worker.RequestCompletions(req, served, w, ctx)
+	})
+}
+
+func (h *Hub) RequestChatCompletions(req message.ChatCompletionsRequest, key *ApiKey, affinity string, w http.ResponseWriter, ctx context.Context) RequestStats {
+	rt := route{model: req.Model, key: key, affinity: affinity}
+	return h.dispatch(rt, w, ctx, func(worker *Worker, served string, model string) (RequestStats, error) {
+		req.Model = model
+		return worker.RequestChatCompletions(req, served, w, ctx)
+	})
+}
+
+func (h *Hub) RequestEmbeddings(req message.EmbeddingsRequest, key *ApiKey, w http.ResponseWriter, ctx context.Context) RequestStats {
+	rt := route{model: req.Model, key: key, embeddings: true}
+	return h.dispatch(rt, w, ctx, func(worker *Worker, served string, model string) (RequestStats, error) {
+		req.Model = model
+		return worker.RequestEmbeddings(req, served, w, ctx)
+	})
+}
+
+// route describes the worker a request has to be sent to.
+type route struct {
+	// model is the requested model, which may be an alias
+	model string
+
+	// key is the API key the request was made with, which restricts the
+	// fallback models that may serve it. Nil if API keys are disabled.
+	key *ApiKey
+
+	// embeddings is set for embeddings requests, the only ones that can be
+	// served by embedding-only models
+	embeddings bool
+
+	// affinity is the key of related requests to send to the same worker
+	affinity string
+}
+
+// acquireWorkerOrFallback reserves a worker for the model, or for one of its
+// fallbacks in order. Fallbacks the API key is not allowed to use are skipped.
+// Each model but the last is waited for up to fallbackAfter before moving on,
+// and the last one for up to queueTimeout. It returns the model the worker was
+// reserved for.
+func (h *Hub) acquireWorkerOrFallback(rt route, ctx context.Context) (*Worker, string, error) {
+	models := []string{rt.model}
+	for _, m := range h.fallbacks[rt.model] {
+		if rt.key.AllowsModel(m) {
+			models = append(models, m)
+		}
 	}
 
-	// Find the worker with the least active tasks
-	var worker *Worker = nil
-	for _, w := range h.workers {
-		if !w.HasModel(req.Model) {
-			continue
+	var err error
+	for i, m := range models {
+		wait := h.queueTimeout
+		if i < len(models)-1 {
+			wait = min(h.fallbackAfter, h.queueTimeout)
 		}
 
-		if worker == nil || w.GetActiveTasks() < worker.GetActiveTasks() {
-			worker = w
+		fallback := rt
+		fallback.model = m
+
+		var worker *Worker
+		if worker, err = h.acquireWorker(fallback, wait, ctx); err == nil {
+			if m != rt.model {
+				log.Printf("Falling back from %s to %s", rt.model, m)
+			}
+			return worker, m, nil
+		}
+		if ctx.Err() != nil {
+			break
 		}
 	}
+	return nil, "", err
+}
 
-	if worker == nil {
-		http.Error(w, "No workers available for model", http.StatusServiceUnavailable)
-		return
+// dispatch selects a worker for the route, possibly serving a fallback model,
+// and passes it to fn along with the model being served and the id the worker
+// knows it by. The request is retried on another worker if the connection to
+// the selected one is lost before anything was written to the client.
+func (h *Hub) dispatch(
+	rt route, w http.ResponseWriter, ctx context.Context,
+	fn func(worker *Worker, served string, model string) (RequestStats, error),
+) RequestStats {
+	worker, served, err := h.acquireWorkerOrFallback(rt, ctx)
+	if err != nil {
+		switch {
+		case ctx.Err() != nil:
+		case errors.Is(err, errQueueFull):
+			http.Error(w, "Request queue is full", http.StatusServiceUnavailable)
+		default:
+			http.Error(w, "No workers available for model", http.StatusServiceUnavailable)
+		}
+		return RequestStats{}
 	}
 
-	// Request completions from the worker
-	if err := worker.RequestCompletions(req, w, ctx); err != nil {
-		if strings.Contains(err.Error(), "websocket: close") || strings.Contains(err.Error(), "write: broken pipe") {
-			log.Printf("Worker connection closed, retrying request: %v", err)
-
+	// Request completions from the worker, which may have dropped the model
+	// since it was selected
+	workerModel, ok := h.workerModel(worker, served, rt.embeddings)
+	if !ok {
+		workerModel = served
+	}
+	w.Header().Set(servedModelHeader, served)
+	stats, err := fn(worker, served, workerModel)
+	h.releaseWorker(worker)
+	h.metrics.observeRequest(worker, served, stats)
+	if ctx.Err() == nil {
+		worker.observeLatency(stats, err != nil || stats.Failed)
+	}
+	if err != nil {
+		if errors.Is(err, errWorkerLost) {
 			// Worker connection closed, remove it from the hub
 			h.UnregisterWorker(worker.Id)
 
-			// Retry the request
-			if ctx.Err() == nil {
-				h.RequestCompletions(req, w, ctx)
+			// Retry the request if the client has not seen any of it yet
+			if stats.Chunks == 0 && ctx.Err() == nil {
+				log.Printf("Worker %v lost, retrying request: %v", worker.Id, err)
+				return h.dispatch(rt, w, ctx, fn)
 			}
-		} else {
+			log.Printf("Worker %v lost mid-stream: %v", worker.Id, err)
+		} else if ctx.Err() == nil {
 			log.Printf("Failed to request completions: %v", err)
 			http.Error(w, "Failed to request completions", http.StatusInternalServerError)
 		}
 	}
+
+	return stats
 }
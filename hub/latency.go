@@ -0,0 +1,68 @@
+package hub
+
+import (
+	"time"
+)
+
+// latencyAlpha is the weight of new observations in the moving averages.
+const latencyAlpha = 0.2
+
+// LatencyStats are exponentially weighted moving averages of how quickly a
+// worker serves requests.
+type LatencyStats struct {
+	// TimeToFirstToken is the average time until the first chunk
+	TimeToFirstToken time.Duration
+
+	// TokensPerSecond is the average generation speed after the first chunk
+	TokensPerSecond float64
+
+	// ErrorRate is the average share of requests that failed
+	ErrorRate float64
+
+	// Samples is the number of requests observed
+	Samples int
+}
+
+func ewma(avg float64, v float64, first bool) float64 {
+	if first {
+		return v
+	}
+	return latencyAlpha*v + (1-latencyAlpha)*avg
+}
+
+// observe updates the averages with a request served by the worker.
+func (l *LatencyStats) observe(stats RequestStats, failed bool) {
+	first := l.Samples == 0
+	l.Samples++
+
+	errored := 0.0
+	if failed {
+		errored = 1
+	}
+	l.ErrorRate = ewma(l.ErrorRate, errored, first)
+
+	if stats.Chunks > 0 {
+		ttft := ewma(float64(l.TimeToFirstToken), float64(stats.TimeToFirstToken), l.TimeToFirstToken == 0)
+		l.TimeToFirstToken = time.Duration(ttft)
+	}
+
+	// Only streams tell the time to first token apart from generation
+	generation := stats.Duration - stats.TimeToFirstToken
+	if stats.Chunks > 1 && generation > 0 {
+		tps := float64(stats.CompletionTokens-1) / generation.Seconds()
+		l.TokensPerSecond = ewma(l.TokensPerSecond, tps, l.TokensPerSecond == 0)
+	}
+}
+
+// GetLatencyStats returns the observed latencies of the worker.
+func (w *Worker) GetLatencyStats() LatencyStats {
+	w.latencyLock.Lock()
+	defer w.latencyLock.Unlock()
+	return w.latency
+}
+
+func (w *Worker) observeLatency(stats RequestStats, failed bool) {
+	w.latencyLock.Lock()
+	defer w.latencyLock.Unlock()
+	w.latency.observe(stats, failed)
+}
@@ -0,0 +1,218 @@
+package hub
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the histogram buckets used for latencies, in seconds.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+
+// histogram is a cumulative histogram in the Prometheus sense.
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(latencyBuckets))
+	}
+	for i, b := range latencyBuckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// metrics collects the hub metrics exposed on /metrics in the Prometheus text
+// format. Metrics derived from the current state of the hub, like the number
+// of connected workers, are computed when scraped.
+type metrics struct {
+	requests map[[2]string]uint64
+	tokens   map[string]uint64
+	ttft     map[string]*histogram
+	duration map[string]*histogram
+	pingRTT  map[string]*histogram
+	lock     sync.Mutex
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests: make(map[[2]string]uint64),
+		tokens:   make(map[string]uint64),
+		ttft:     make(map[string]*histogram),
+		duration: make(map[string]*histogram),
+		pingRTT:  make(map[string]*histogram),
+	}
+}
+
+func observe(m map[string]*histogram, key string, d time.Duration) {
+	h, ok := m[key]
+	if !ok {
+		h = &histogram{}
+		m[key] = h
+	}
+	h.observe(d.Seconds())
+}
+
+// countRequest records a client request for the model with the response status.
+func (m *metrics) countRequest(model string, status int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.requests[[2]string{model, strconv.Itoa(status)}]++
+}
+
+// observeRequest records the latencies and tokens of a request served by the
+// worker.
+func (m *metrics) observeRequest(worker *Worker, model string, stats RequestStats) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	name := worker.GetInfo().WorkerName
+	if stats.Chunks > 0 {
+		observe(m.ttft, name, stats.TimeToFirstToken)
+	}
+	observe(m.duration, name, stats.Duration)
+	m.tokens[model] += uint64(stats.CompletionTokens)
+}
+
+// observePing records the round trip time of a ping to the worker.
+func (m *metrics) observePing(worker *Worker, rtt time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	observe(m.pingRTT, worker.GetInfo().WorkerName, rtt)
+}
+
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeHeader(w io.Writer, name string, typ string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func writeHistograms(w io.Writer, name string, help string, label string, m map[string]*histogram) {
+	writeHeader(w, name, "histogram", help)
+	for _, key := range sortedKeys(m) {
+		h := m[key]
+		lv := escapeLabel(key)
+		for i, b := range latencyBuckets {
+			fmt.Fprintf(w, "%s_bucket{%s=\"%s\",le=\"%s\"} %d\n", name, label, lv, formatFloat(b), h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s=\"%s\",le=\"+Inf\"} %d\n", name, label, lv, h.count)
+		fmt.Fprintf(w, "%s_sum{%s=\"%s\"} %s\n", name, label, lv, formatFloat(h.sum))
+		fmt.Fprintf(w, "%s_count{%s=\"%s\"} %d\n", name, label, lv, h.count)
+	}
+}
+
+// writeMetrics writes all metrics in the Prometheus text format.
+func (h *Hub) writeMetrics(w io.Writer) {
+	m := h.metrics
+	m.lock.Lock()
+
+	writeHeader(w, "lmrouter_requests_total", "counter", "Number of client requests by model and response status.")
+	requestKeys := make([][2]string, 0, len(m.requests))
+	for k := range m.requests {
+		requestKeys = append(requestKeys, k)
+	}
+	sort.Slice(requestKeys, func(i, j int) bool {
+		if requestKeys[i][0] != requestKeys[j][0] {
+			return requestKeys[i][0] < requestKeys[j][0]
+		}
+		return requestKeys[i][1] < requestKeys[j][1]
+	})
+	for _, k := range requestKeys {
+		fmt.Fprintf(w, "lmrouter_requests_total{model=\"%s\",status=\"%s\"} %d\n",
+			escapeLabel(k[0]), k[1], m.requests[k])
+	}
+
+	writeHeader(w, "lmrouter_completion_tokens_total", "counter", "Number of completion tokens relayed to clients by model.")
+	for _, model := range sortedKeys(m.tokens) {
+		fmt.Fprintf(w, "lmrouter_completion_tokens_total{model=\"%s\"} %d\n", escapeLabel(model), m.tokens[model])
+	}
+
+	writeHistograms(w, "lmrouter_time_to_first_token_seconds",
+		"Time from dispatching a request to receiving its first chunk, by worker.", "worker", m.ttft)
+	writeHistograms(w, "lmrouter_request_duration_seconds",
+		"Time from dispatching a request to receiving its last chunk, by worker.", "worker", m.duration)
+	writeHistograms(w, "lmrouter_worker_ping_rtt_seconds",
+		"Round trip time of pings to workers, by worker.", "worker", m.pingRTT)
+
+	m.lock.Unlock()
+
+	// Metrics computed from the current state of the hub
+	workers := h.GetWorkers()
+	sort.Slice(workers, func(i, j int) bool {
+		return workers[i].Id.String() < workers[j].Id.String()
+	})
+
+	writeHeader(w, "lmrouter_connected_workers", "gauge", "Number of workers connected to the hub.")
+	fmt.Fprintf(w, "lmrouter_connected_workers %d\n", len(workers))
+
+	writeHeader(w, "lmrouter_worker_active_tasks", "gauge", "Number of requests in progress on each worker.")
+	for _, worker := range workers {
+		fmt.Fprintf(w, "lmrouter_worker_active_tasks{worker=\"%s\",worker_id=\"%s\"} %d\n",
+			escapeLabel(worker.GetInfo().WorkerName), worker.Id, worker.GetActiveTasks())
+	}
+
+	writeHeader(w, "lmrouter_queue_depth", "gauge", "Number of requests waiting for a worker by model.")
+	depths := h.queue.depths()
+	for _, model := range sortedKeys(depths) {
+		fmt.Fprintf(w, "lmrouter_queue_depth{model=\"%s\"} %d\n", escapeLabel(model), depths[model])
+	}
+}
+
+// statusWriter records the status code written to a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// instrument wraps a handler to count its requests by model and status. The
+// handler returns the model that was requested.
+func (h *Hub) instrument(handler func(w http.ResponseWriter, r *http.Request) string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		model := handler(sw, r)
+
+		// Avoid unbounded label values from arbitrary model names
+		if !h.servesModel(model) {
+			model = "other"
+		}
+		h.metrics.countRequest(model, sw.status)
+	}
+}
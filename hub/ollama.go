@@ -0,0 +1,270 @@
+package hub
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/hizkifw/lmrouter/message"
+)
+
+// ollamaStream reports whether an Ollama request streams its response, which
+// is the default.
+func ollamaStream(stream *bool) bool {
+	return stream == nil || *stream
+}
+
+// ollamaCompletionsRequest translates a raw Ollama generate request, whose
+// prompt is not templated, into a completions request.
+func ollamaCompletionsRequest(req message.OllamaGenerateRequest) message.CompletionsRequest {
+	compReq := message.CompletionsRequest{
+		Model:  req.Model,
+		Prompt: req.Prompt,
+		Stream: ollamaStream(req.Stream),
+	}
+	if req.Suffix != "" {
+		compReq.Suffix = &req.Suffix
+	}
+	if opts := req.Options; opts != nil {
+		compReq.MaxTokens = opts.NumPredict
+		compReq.Temperature = opts.Temperature
+		compReq.TopP = opts.TopP
+		compReq.Seed = opts.Seed
+		compReq.Stop = opts.Stop
+	}
+	return compReq
+}
+
+// ollamaChatRequest translates an Ollama chat request, or a generate request
+// whose prompt is templated by the inference server, into a chat completions
+// request.
+func ollamaChatRequest(model string, messages []message.OllamaMessage, stream *bool, opts *message.OllamaOptions) message.ChatCompletionsRequest {
+	chatReq := message.ChatCompletionsRequest{
+		Model:    model,
+		Messages: make([]message.ChatMessage, 0, len(messages)),
+		Stream:   ollamaStream(stream),
+	}
+	for _, m := range messages {
+		chatReq.Messages = append(chatReq.Messages, message.ChatMessage{Role: m.Role, Content: m.Content})
+	}
+	if opts != nil {
+		chatReq.MaxTokens = opts.NumPredict
+		chatReq.Temperature = opts.Temperature
+		chatReq.TopP = opts.TopP
+		chatReq.Seed = opts.Seed
+		chatReq.Stop = opts.Stop
+	}
+	return chatReq
+}
+
+// ollamaGenerateMessages returns the chat messages of a templated Ollama
+// generate request.
+func ollamaGenerateMessages(req message.OllamaGenerateRequest) []message.OllamaMessage {
+	messages := make([]message.OllamaMessage, 0, 2)
+	if req.System != "" {
+		messages = append(messages, message.OllamaMessage{Role: "system", Content: req.System})
+	}
+	return append(messages, message.OllamaMessage{Role: "user", Content: req.Prompt})
+}
+
+// ollamaDoneReason maps an OpenAI finish reason to an Ollama done reason.
+func ollamaDoneReason(finishReason string) string {
+	if finishReason == "length" {
+		return "length"
+	}
+	return "stop"
+}
+
+// ollamaTags lists models in the format of the Ollama tags endpoint.
+func ollamaTags(models []message.Model) message.OllamaTagsResponse {
+	resp := message.OllamaTagsResponse{Models: make([]message.OllamaModel, 0, len(models))}
+	for _, model := range models {
+		resp.Models = append(resp.Models, message.OllamaModel{
+			Name:       model.Id,
+			Model:      model.Id,
+			ModifiedAt: time.Unix(int64(model.Created), 0).UTC().Format(time.RFC3339),
+		})
+	}
+	return resp
+}
+
+// openaiChunk holds the fields of OpenAI completions and chat completions
+// responses, streamed or not, needed to translate them.
+type openaiChunk struct {
+	Choices []struct {
+		Index        int                  `json:"index"`
+		Text         string               `json:"text"`
+		Delta        *message.ChatMessage `json:"delta"`
+		Message      *message.ChatMessage `json:"message"`
+		FinishReason *string              `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *message.CompletionsUsage `json:"usage"`
+}
+
+// text returns the text of the first choice of the chunk.
+func (c *openaiChunk) text() string {
+	for _, choice := range c.Choices {
+		if choice.Index != 0 {
+			continue
+		}
+		switch {
+		case choice.Delta != nil:
+			text, _ := choice.Delta.Content.(string)
+			return text
+		case choice.Message != nil:
+			text, _ := choice.Message.Content.(string)
+			return text
+		default:
+			return choice.Text
+		}
+	}
+	return ""
+}
+
+// ollamaWriter translates the OpenAI completions and chat completions
+// responses and errors written to it into the Ollama API format, streamed as
+// newline-delimited JSON.
+type ollamaWriter struct {
+	*translatingWriter
+
+	// chat is set for the chat endpoint, whose responses hold a message
+	// rather than the generated text
+	chat bool
+
+	// model is the model as requested by the client
+	model string
+
+	// State of the stream being translated
+	start           time.Time
+	failed          bool
+	doneReason      string
+	promptEvalCount int
+	evalCount       int
+}
+
+func newOllamaWriter(w http.ResponseWriter, chat bool) *ollamaWriter {
+	ow := &ollamaWriter{chat: chat, start: time.Now()}
+	ow.translatingWriter = newTranslatingWriter(w, ow.translateEvent)
+	return ow
+}
+
+// writeLine writes an Ollama response holding the text to the client.
+func (w *ollamaWriter) writeLine(text string, stats message.OllamaStats) {
+	createdAt := time.Now().UTC().Format(time.RFC3339Nano)
+	if w.chat {
+		json.NewEncoder(w.ResponseWriter).Encode(message.OllamaChatResponse{
+			Model:       w.model,
+			CreatedAt:   createdAt,
+			Message:     message.OllamaMessage{Role: "assistant", Content: text},
+			OllamaStats: stats,
+		})
+	} else {
+		json.NewEncoder(w.ResponseWriter).Encode(message.OllamaGenerateResponse{
+			Model:       w.model,
+			CreatedAt:   createdAt,
+			Response:    text,
+			OllamaStats: stats,
+		})
+	}
+	w.Flush()
+}
+
+// observe records the finish reason and usage reported in the chunk.
+func (w *ollamaWriter) observe(chunk *openaiChunk) {
+	for _, choice := range chunk.Choices {
+		if choice.Index == 0 && choice.FinishReason != nil {
+			w.doneReason = ollamaDoneReason(*choice.FinishReason)
+		}
+	}
+	if chunk.Usage != nil {
+		w.promptEvalCount = chunk.Usage.PromptTokens
+		w.evalCount = chunk.Usage.CompletionTokens
+	}
+}
+
+// doneStats returns the stats of the final response.
+func (w *ollamaWriter) doneStats() message.OllamaStats {
+	if w.doneReason == "" {
+		w.doneReason = "stop"
+	}
+	return message.OllamaStats{
+		Done:            true,
+		DoneReason:      w.doneReason,
+		TotalDuration:   time.Since(w.start).Nanoseconds(),
+		PromptEvalCount: w.promptEvalCount,
+		EvalCount:       w.evalCount,
+	}
+}
+
+// translateEvent converts an OpenAI SSE event into an Ollama response line.
+func (w *ollamaWriter) translateEvent(data []byte, isError bool) {
+	if isError {
+		w.failed = true
+		json.NewEncoder(w.ResponseWriter).Encode(message.OllamaErrorResponse{
+			Error: errorMessage(http.StatusBadGateway, data),
+		})
+		w.Flush()
+		return
+	}
+
+	var chunk openaiChunk
+	if err := json.Unmarshal(data, &chunk); err != nil {
+		return
+	}
+	if chunk.Usage == nil {
+		// Estimate one token per chunk if the worker does not report usage
+		w.evalCount++
+	}
+	w.observe(&chunk)
+	if text := chunk.text(); text != "" {
+		w.writeLine(text, message.OllamaStats{})
+	}
+}
+
+func (w *ollamaWriter) WriteHeader(status int) {
+	if w.stream && status == http.StatusOK {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.translatingWriter.WriteHeader(status)
+}
+
+func (w *ollamaWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.translatingWriter.Write(p)
+}
+
+// finish writes the translated response once the request has been served.
+func (w *ollamaWriter) finish() {
+	switch {
+	case w.status == 0:
+		// Nothing was written, the client went away
+		return
+
+	case w.status != http.StatusOK:
+		w.Header().Set("Content-Type", "application/json")
+		w.ResponseWriter.WriteHeader(w.status)
+		json.NewEncoder(w.ResponseWriter).Encode(message.OllamaErrorResponse{
+			Error: errorMessage(w.status, w.buf.Bytes()),
+		})
+
+	case !w.stream:
+		var chunk openaiChunk
+		if err := json.Unmarshal(w.buf.Bytes(), &chunk); err != nil || len(chunk.Choices) == 0 {
+			w.Header().Set("Content-Type", "application/json")
+			w.ResponseWriter.WriteHeader(http.StatusBadGateway)
+			json.NewEncoder(w.ResponseWriter).Encode(message.OllamaErrorResponse{
+				Error: "Failed to parse response from worker",
+			})
+			return
+		}
+		w.observe(&chunk)
+		w.Header().Set("Content-Type", "application/json")
+		w.ResponseWriter.WriteHeader(http.StatusOK)
+		w.writeLine(chunk.text(), w.doneStats())
+
+	case !w.failed:
+		w.writeLine("", w.doneStats())
+	}
+}
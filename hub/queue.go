@@ -0,0 +1,207 @@
+package hub
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+)
+
+var (
+	errNoWorkers  = errors.New("no workers available for model")
+	errQueueFull  = errors.New("request queue is full")
+	errQueueTimed = errors.New("timed out waiting for a worker")
+)
+
+// waiter is a request waiting in the queue for a worker to become available.
+type waiter struct {
+	model string
+	ready chan struct{}
+}
+
+// requestQueue holds requests waiting for a worker, in a bounded FIFO queue per
+// model. Only the request at the head of a queue tries to acquire a worker, so
+// that requests are served in the order they arrived.
+type requestQueue struct {
+	waiters map[string][]*waiter
+	maxSize int
+	lock    sync.Mutex
+}
+
+func newRequestQueue(maxSize int) *requestQueue {
+	return &requestQueue{
+		waiters: make(map[string][]*waiter),
+		maxSize: maxSize,
+	}
+}
+
+// len returns the number of requests waiting for the model.
+func (q *requestQueue) len(model string) int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.waiters[model])
+}
+
+// depths returns the number of requests waiting for each model.
+func (q *requestQueue) depths() map[string]int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	depths := make(map[string]int, len(q.waiters))
+	for model, waiters := range q.waiters {
+		depths[model] = len(waiters)
+	}
+	return depths
+}
+
+// push adds a request to the queue, returning nil if the queue is full.
+func (q *requestQueue) push(model string) *waiter {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if len(q.waiters[model]) >= q.maxSize {
+		return nil
+	}
+
+	wt := &waiter{model: model, ready: make(chan struct{}, 1)}
+	q.waiters[model] = append(q.waiters[model], wt)
+	return wt
+}
+
+// remove takes a request out of the queue and wakes up the next one.
+func (q *requestQueue) remove(wt *waiter) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	waiters := q.waiters[wt.model]
+	for i, w := range waiters {
+		if w == wt {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+
+	if len(waiters) == 0 {
+		delete(q.waiters, wt.model)
+		return
+	}
+	q.waiters[wt.model] = waiters
+	waiters[0].wake()
+}
+
+// isHead reports whether the request is first in line for its model.
+func (q *requestQueue) isHead(wt *waiter) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	waiters := q.waiters[wt.model]
+	return len(waiters) > 0 && waiters[0] == wt
+}
+
+// wakeAll wakes up the first request for every model, so that it can try to
+// acquire a worker again.
+func (q *requestQueue) wakeAll() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for _, waiters := range q.waiters {
+		waiters[0].wake()
+	}
+}
+
+func (wt *waiter) wake() {
+	select {
+	case wt.ready <- struct{}{}:
+	default:
+	}
+}
+
+// acquireWorker reserves a worker for the route. If none is available, the
+// request waits in the queue of the model for up to wait for one to free up or
+// register.
+func (h *Hub) acquireWorker(rt route, wait time.Duration, ctx context.Context) (*Worker, error) {
+	// Only skip the queue if nobody is waiting already
+	if h.queue.len(rt.model) == 0 {
+		if worker := h.reserveWorker(rt); worker != nil {
+			return worker, nil
+		}
+	}
+
+	if wait <= 0 {
+		return nil, errNoWorkers
+	}
+
+	wt := h.queue.push(rt.model)
+	if wt == nil {
+		return nil, errQueueFull
+	}
+	defer h.queue.remove(wt)
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		if h.queue.isHead(wt) {
+			if worker := h.reserveWorker(rt); worker != nil {
+				return worker, nil
+			}
+		}
+
+		select {
+		case <-wt.ready:
+		case <-timer.C:
+			return nil, errQueueTimed
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// reserveWorker reserves a task slot on the worker for the route chosen by the
+// routing policy, or returns nil if all of them are full or draining. If the
+// route has an affinity key, the worker it hashes to is preferred unless it is
+// busy compared to the others.
+func (h *Hub) reserveWorker(rt route) *Worker {
+	for {
+		serving := make([]*Worker, 0)
+		candidates := make([]*Worker, 0)
+		for _, w := range h.GetWorkers() {
+			if _, ok := h.workerModel(w, rt.model, rt.embeddings); !ok || w.IsDraining() {
+				continue
+			}
+			serving = append(serving, w)
+			if w.HasCapacity() {
+				candidates = append(candidates, w)
+			}
+		}
+
+		if rt.affinity != "" {
+			if worker := affinityWorker(rt.affinity, serving); worker != nil {
+				if !affinityBusy(worker, candidates) && worker.reserve() {
+					return worker
+				}
+
+				// Spill over to the other workers, which the policy could
+				// otherwise choose the busy one over
+				candidates = slices.DeleteFunc(candidates, func(w *Worker) bool { return w == worker })
+			}
+		}
+
+		worker := h.routing.choose(candidates)
+		if worker == nil {
+			return nil
+		}
+
+		// Another request may have taken the last slot in the meantime
+		if worker.reserve() {
+			return worker
+		}
+	}
+}
+
+// releaseWorker frees the task slot reserved by reserveWorker.
+func (h *Hub) releaseWorker(worker *Worker) {
+	worker.release()
+	h.queue.wakeAll()
+}
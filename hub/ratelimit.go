@@ -0,0 +1,219 @@
+package hub
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit limits how much of the fleet a single client can use. Zero values
+// disable the corresponding limit.
+type RateLimit struct {
+	// RequestsPerMinute is the number of requests allowed per minute
+	RequestsPerMinute int `json:"requests_per_minute,omitempty"`
+
+	// TokensPerMinute is the number of completion tokens allowed per minute
+	TokensPerMinute int `json:"tokens_per_minute,omitempty"`
+
+	// MaxConcurrent is the number of requests that may be in progress at once
+	MaxConcurrent int `json:"max_concurrent,omitempty"`
+}
+
+// tokenBucket is a token bucket that refills continuously. The number of
+// tokens may go negative when usage is only known after the fact, in which
+// case the bucket has to refill before it can be used again.
+type tokenBucket struct {
+	capacity float64
+	tokens   float64
+	rate     float64
+	last     time.Time
+}
+
+func newTokenBucket(perMinute int, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		capacity: float64(perMinute),
+		tokens:   float64(perMinute),
+		rate:     float64(perMinute) / 60,
+		last:     now,
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.capacity, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// wait returns how long until n tokens are available.
+func (b *tokenBucket) wait(n float64, now time.Time) time.Duration {
+	b.refill(now)
+	if b.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) take(n float64, now time.Time) {
+	b.refill(now)
+	b.tokens -= n
+}
+
+func (b *tokenBucket) full(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.capacity
+}
+
+// clientLimiter tracks the usage of a single client.
+type clientLimiter struct {
+	requests *tokenBucket
+	tokens   *tokenBucket
+	active   int
+}
+
+// rateLimiter enforces rate limits per client, identified by API key or IP.
+type rateLimiter struct {
+	clients   map[string]*clientLimiter
+	lastSweep time.Time
+	lock      sync.Mutex
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		clients:   make(map[string]*clientLimiter),
+		lastSweep: time.Now(),
+	}
+}
+
+// acquire reserves a request slot for the client. If the client is over its
+// limit, it returns how long to wait before retrying and what was exceeded.
+// Otherwise it returns a function that must be called with the number of
+// completion tokens used once the request has completed.
+func (rl *rateLimiter) acquire(client string, limit RateLimit) (func(int), time.Duration, string) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	now := time.Now()
+	rl.sweep(now)
+
+	c, ok := rl.clients[client]
+	if !ok {
+		c = &clientLimiter{}
+		if limit.RequestsPerMinute > 0 {
+			c.requests = newTokenBucket(limit.RequestsPerMinute, now)
+		}
+		if limit.TokensPerMinute > 0 {
+			c.tokens = newTokenBucket(limit.TokensPerMinute, now)
+		}
+		rl.clients[client] = c
+	}
+
+	if limit.MaxConcurrent > 0 && c.active >= limit.MaxConcurrent {
+		return nil, time.Second, "concurrent requests"
+	}
+	if c.requests != nil {
+		if wait := c.requests.wait(1, now); wait > 0 {
+			return nil, wait, "requests per minute"
+		}
+	}
+	if c.tokens != nil {
+		// Token usage is only known afterwards, so only require the
+		// bucket to not be in debt
+		if wait := c.tokens.wait(0, now); wait > 0 {
+			return nil, wait, "tokens per minute"
+		}
+	}
+
+	if c.requests != nil {
+		c.requests.take(1, now)
+	}
+	c.active++
+
+	released := false
+	return func(tokens int) {
+		rl.lock.Lock()
+		defer rl.lock.Unlock()
+
+		if released {
+			return
+		}
+		released = true
+
+		c.active--
+		if c.tokens != nil {
+			c.tokens.take(float64(tokens), time.Now())
+		}
+	}, 0, ""
+}
+
+// sweep forgets clients that are idle and back at full capacity, so that the
+// map does not grow forever. Must be called with rl.lock held.
+func (rl *rateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < time.Minute {
+		return
+	}
+	rl.lastSweep = now
+
+	for client, c := range rl.clients {
+		if c.active > 0 {
+			continue
+		}
+		if c.requests != nil && !c.requests.full(now) {
+			continue
+		}
+		if c.tokens != nil && !c.tokens.full(now) {
+			continue
+		}
+		delete(rl.clients, client)
+	}
+}
+
+// clientIP returns the IP address of the client that made the request.
+func clientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			ip, _, _ := strings.Cut(fwd, ",")
+			return strings.TrimSpace(ip)
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// limit applies the rate limit for the client making the request, writing a
+// 429 response if it is exceeded. On success, the returned function must be
+// called with the number of completion tokens used once the request is done.
+func (h *Hub) limit(w http.ResponseWriter, r *http.Request, key *ApiKey) (func(int), bool) {
+	limit := h.rateLimit
+	client := "ip:" + clientIP(r, h.trustProxy)
+	if key != nil {
+		client = "key:" + key.Key
+		if key.RateLimit != nil {
+			limit = key.RateLimit
+		}
+	}
+	if limit == nil {
+		return func(int) {}, true
+	}
+
+	release, wait, exceeded := h.rateLimiter.acquire(client, *limit)
+	if release != nil {
+		return release, true
+	}
+
+	retryAfter := int(math.Ceil(wait.Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	writeError(w, http.StatusTooManyRequests, "rate_limit_error", "rate_limit_exceeded",
+		fmt.Sprintf("Rate limit reached for %s. Please try again in %ds.", exceeded, retryAfter))
+	return nil, false
+}
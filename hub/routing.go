@@ -0,0 +1,140 @@
+package hub
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"sort"
+	"sync"
+	"time"
+)
+
+// routingPolicy picks the worker to serve a request among candidates that
+// serve the model and have a free slot.
+type routingPolicy interface {
+	choose(candidates []*Worker) *Worker
+}
+
+// routingPolicies are the policies that can be selected with --routing.
+var routingPolicies = map[string]func() routingPolicy{
+	"least-tasks": func() routingPolicy { return leastTasks{} },
+	"round-robin": func() routingPolicy { return &roundRobin{} },
+	"random":      func() routingPolicy { return random{} },
+	"weighted":    func() routingPolicy { return weighted{} },
+	"latency":     func() routingPolicy { return latencyAware{} },
+}
+
+func newRoutingPolicy(name string) (routingPolicy, error) {
+	newPolicy, ok := routingPolicies[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown routing policy %q, expected one of %v", name, sortedKeys(routingPolicies))
+	}
+	return newPolicy(), nil
+}
+
+// leastTasks picks the worker with the largest share of free slots, scaled by
+// its weight.
+type leastTasks struct{}
+
+func (leastTasks) choose(candidates []*Worker) *Worker {
+	var worker *Worker
+	var workerLoad float64
+	for _, w := range candidates {
+		// Offset the load so that idle workers are also told apart by weight
+		if load := (w.Load() + 1) / w.GetWeight(); worker == nil || load < workerLoad {
+			worker = w
+			workerLoad = load
+		}
+	}
+	return worker
+}
+
+// roundRobin cycles through the workers in turn.
+type roundRobin struct {
+	next uint64
+	lock sync.Mutex
+}
+
+func (p *roundRobin) choose(candidates []*Worker) *Worker {
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	// Keep a stable order, the candidates come from a map
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Id.String() < candidates[j].Id.String()
+	})
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	worker := candidates[p.next%uint64(len(candidates))]
+	p.next++
+	return worker
+}
+
+// random picks any worker.
+type random struct{}
+
+func (random) choose(candidates []*Worker) *Worker {
+	if len(candidates) == 0 {
+		return nil
+	}
+	return candidates[rand.IntN(len(candidates))]
+}
+
+// weighted picks a random worker with a probability proportional to its
+// weight.
+type weighted struct{}
+
+func (weighted) choose(candidates []*Worker) *Worker {
+	total := 0.0
+	for _, w := range candidates {
+		total += w.GetWeight()
+	}
+
+	r := rand.Float64() * total
+	for _, w := range candidates {
+		if r -= w.GetWeight(); r < 0 {
+			return w
+		}
+	}
+	if len(candidates) > 0 {
+		return candidates[len(candidates)-1]
+	}
+	return nil
+}
+
+// nominalTokens is the response length assumed when estimating latency.
+const nominalTokens = 128
+
+// latencyAware picks the worker expected to complete a request soonest, based
+// on its observed time to first token and generation speed, slowed down by the
+// requests it is already serving and inflated by its error rate. Workers that
+// have not served any request yet are tried first.
+type latencyAware struct{}
+
+func (latencyAware) expectedLatency(w *Worker) time.Duration {
+	stats := w.GetLatencyStats()
+	if stats.Samples == 0 {
+		return 0
+	}
+
+	expected := stats.TimeToFirstToken.Seconds()
+	if stats.TokensPerSecond > 0 {
+		expected += nominalTokens / stats.TokensPerSecond
+	}
+	expected *= 1 + w.Load()
+	expected /= max(1-stats.ErrorRate, 0.01)
+	return time.Duration(expected * float64(time.Second))
+}
+
+func (p latencyAware) choose(candidates []*Worker) *Worker {
+	var worker *Worker
+	var workerLatency time.Duration
+	for _, w := range candidates {
+		if latency := p.expectedLatency(w); worker == nil || latency < workerLatency {
+			worker = w
+			workerLatency = latency
+		}
+	}
+	return worker
+}
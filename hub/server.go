@@ -22,16 +22,113 @@ var indexHTML []byte
 type ServerOpts struct {
 	// Addr is the address to listen on
 	Addr string `arg:"--listen" help:"address to listen on" default:":9090"`
+
+	// WorkerTokens are the shared secrets workers must present to register
+	WorkerTokens []string `arg:"--worker-token,separate,env:WORKER_TOKEN" help:"shared secret workers must present to register, may be repeated"`
+
+	// AdminTokens are the tokens accepted for the admin API. If none are
+	// set, the admin API is disabled.
+	AdminTokens []string `arg:"--admin-token,separate,env:ADMIN_TOKEN" help:"token for the admin API, may be repeated, the admin API is disabled if unset"`
+
+	// WorkerTokenFile is a file containing worker tokens, one per line
+	WorkerTokenFile string `arg:"--worker-token-file" help:"file containing worker tokens, one per line"`
+
+	// Routing is the name of the policy used to pick a worker for each request
+	Routing string `arg:"--routing" help:"worker selection policy: least-tasks, round-robin, random, weighted or latency" default:"least-tasks"`
+
+	// AffinityPrefix is the number of prompt bytes hashed to send requests
+	// sharing a prefix to the same worker, so that it can reuse its KV cache
+	AffinityPrefix int `arg:"--affinity-prefix" help:"send requests sharing a prompt prefix of this many bytes to the same worker, 0 to disable prefix hashing" default:"0"`
+
+	// AffinityHeader is the request header identifying a session, used
+	// instead of the prompt prefix for affinity routing when set. It enables
+	// affinity routing on its own, without prefix hashing.
+	AffinityHeader string `arg:"--affinity-header" help:"request header identifying a session for affinity routing (e.g. X-Session-Id), can be used without --affinity-prefix"`
+
+	// QueueSize is the number of requests that may wait for a worker per
+	// model, 64 if unset
+	QueueSize int `arg:"--queue-size" help:"number of requests that may wait for a worker per model" default:"64"`
+
+	// QueueTimeout is how long requests wait for a worker before failing
+	QueueTimeout time.Duration `arg:"--queue-timeout" help:"how long requests wait for a worker before failing, 0 to fail immediately" default:"0s"`
+
+	// FallbackAfter is how long requests wait for a worker before falling
+	// back to the next model configured for the requested one
+	FallbackAfter time.Duration `arg:"--fallback-after" help:"how long requests wait for a worker before falling back to another model, bounded by the queue timeout" default:"0s"`
+
+	// ShutdownTimeout is how long to wait for requests in progress to
+	// complete when shutting down
+	ShutdownTimeout time.Duration `arg:"--shutdown-timeout" help:"how long to wait for requests in progress to complete when shutting down" default:"30s"`
+
+	// ConfigFile is the path to the JSON configuration file
+	ConfigFile string `arg:"--config" help:"path to the JSON configuration file"`
 }
 
 func RunServer(opts *ServerOpts, ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	// Create the hub
 	var hub = Hub{
-		workers: make(map[uuid.UUID]*Worker),
+		workers:        make(map[uuid.UUID]*Worker),
+		workerTokens:   opts.WorkerTokens,
+		adminTokens:    opts.AdminTokens,
+		bannedWorkers:  make(map[string]bool),
+		queueTimeout:   opts.QueueTimeout,
+		fallbackAfter:  opts.FallbackAfter,
+		affinityPrefix: opts.AffinityPrefix,
+		affinityHeader: opts.AffinityHeader,
+		metrics:        newMetrics(),
+	}
+	policy := opts.Routing
+	if policy == "" {
+		policy = "least-tasks"
+	}
+	routing, err := newRoutingPolicy(policy)
+	if err != nil {
+		return err
+	}
+	hub.routing = routing
+	queueSize := opts.QueueSize
+	if queueSize <= 0 {
+		queueSize = 64
+	}
+	hub.queue = newRequestQueue(queueSize)
+	if opts.WorkerTokenFile != "" {
+		tokens, err := loadTokens(opts.WorkerTokenFile)
+		if err != nil {
+			return err
+		}
+		hub.workerTokens = append(hub.workerTokens, tokens...)
+	}
+	if len(hub.workerTokens) == 0 {
+		log.Println("No worker tokens configured, any worker will be able to register")
 	}
 
+	// Load the configuration file
+	config := &Config{}
+	if opts.ConfigFile != "" {
+		var err error
+		if config, err = loadConfig(opts.ConfigFile); err != nil {
+			return err
+		}
+	}
+	hub.apiKeys = make(map[string]*ApiKey, len(config.ApiKeys))
+	for i := range config.ApiKeys {
+		hub.apiKeys[config.ApiKeys[i].Key] = &config.ApiKeys[i]
+	}
+	hub.rateLimit = config.RateLimit
+	hub.rateLimiter = newRateLimiter()
+	hub.trustProxy = config.TrustProxy
+	aliases, err := compileAliases(config.Aliases)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	hub.aliases = aliases
+	hub.fallbacks = config.Fallbacks
+
 	// Begin background processes
-	go hub.PingLoop()
+	go hub.PingLoop(ctx)
 
 	mux := http.NewServeMux()
 
@@ -42,41 +139,298 @@ func RunServer(opts *ServerOpts, ctx context.Context) error {
 	})
 
 	// Handle the completions endpoint
-	mux.HandleFunc("/v1/completions", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/v1/completions", hub.instrument(hub.accept(func(w http.ResponseWriter, r *http.Request) string {
+		key, ok := hub.authenticate(w, r)
+		if !ok {
+			return ""
+		}
+
 		// Parse the completions request
 		req := message.CompletionsRequest{}
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			http.Error(w, "Failed to parse request", http.StatusBadRequest)
-			return
+			return ""
+		}
+		if !authorizeModel(w, key, req.Model) {
+			return req.Model
+		}
+		release, ok := hub.limit(w, r, key)
+		if !ok {
+			return req.Model
+		}
+
+		// Request completions from the workers
+		affinity := hub.affinityKey(r, req.User, req.Prompt)
+		stats := hub.RequestCompletions(req, key, affinity, w, r.Context())
+		release(stats.CompletionTokens)
+
+		return req.Model
+	})))
+
+	// Handle the chat completions endpoint
+	mux.HandleFunc("/v1/chat/completions", hub.instrument(hub.accept(func(w http.ResponseWriter, r *http.Request) string {
+		key, ok := hub.authenticate(w, r)
+		if !ok {
+			return ""
+		}
+
+		// Parse the chat completions request
+		req := message.ChatCompletionsRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Failed to parse request", http.StatusBadRequest)
+			return ""
+		}
+		if !authorizeModel(w, key, req.Model) {
+			return req.Model
+		}
+		release, ok := hub.limit(w, r, key)
+		if !ok {
+			return req.Model
+		}
+
+		// Request chat completions from the workers
+		affinity := hub.affinityKey(r, req.User, chatPrefix(req.Messages))
+		stats := hub.RequestChatCompletions(req, key, affinity, w, r.Context())
+		release(stats.CompletionTokens)
+
+		return req.Model
+	})))
+
+	// Handle the Anthropic messages endpoint, translating to chat completions
+	mux.HandleFunc("/v1/messages", hub.instrument(func(w http.ResponseWriter, r *http.Request) string {
+		aw := newAnthropicWriter(w)
+		if !hub.admit(aw) {
+			aw.finish()
+			return ""
+		}
+		defer hub.endRequest()
+		defer aw.finish()
+
+		key, ok := hub.authenticate(aw, r)
+		if !ok {
+			return ""
+		}
+
+		// Parse the messages request
+		req := message.AnthropicMessagesRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(aw, "Failed to parse request", http.StatusBadRequest)
+			return ""
+		}
+		chatReq, err := anthropicChatRequest(req)
+		if err != nil {
+			http.Error(aw, err.Error(), http.StatusBadRequest)
+			return req.Model
+		}
+		aw.stream = req.Stream
+		if !authorizeModel(aw, key, req.Model) {
+			return req.Model
+		}
+		release, ok := hub.limit(aw, r, key)
+		if !ok {
+			return req.Model
+		}
+
+		// Request chat completions from the workers
+		affinity := hub.affinityKey(r, chatReq.User, chatPrefix(chatReq.Messages))
+		stats := hub.RequestChatCompletions(chatReq, key, affinity, aw, r.Context())
+		release(stats.CompletionTokens)
+
+		return req.Model
+	}))
+
+	// Handle the Ollama generate endpoint. Raw prompts are sent as completions,
+	// others as chat completions so that the inference server templates them.
+	mux.HandleFunc("/api/generate", hub.instrument(func(w http.ResponseWriter, r *http.Request) string {
+		ow := newOllamaWriter(w, false)
+		if !hub.admit(ow) {
+			ow.finish()
+			return ""
+		}
+		defer hub.endRequest()
+		defer ow.finish()
+
+		key, ok := hub.authenticate(ow, r)
+		if !ok {
+			return ""
+		}
+
+		// Parse the generate request
+		req := message.OllamaGenerateRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(ow, "Failed to parse request", http.StatusBadRequest)
+			return ""
+		}
+		ow.model = req.Model
+		ow.stream = ollamaStream(req.Stream)
+		if !authorizeModel(ow, key, req.Model) {
+			return req.Model
+		}
+		release, ok := hub.limit(ow, r, key)
+		if !ok {
+			return req.Model
 		}
 
 		// Request completions from the workers
-		hub.RequestCompletions(req, w, r.Context())
+		var stats RequestStats
+		if req.Raw {
+			affinity := hub.affinityKey(r, "", req.Prompt)
+			stats = hub.RequestCompletions(ollamaCompletionsRequest(req), key, affinity, ow, r.Context())
+		} else {
+			chatReq := ollamaChatRequest(req.Model, ollamaGenerateMessages(req), req.Stream, req.Options)
+			affinity := hub.affinityKey(r, "", chatPrefix(chatReq.Messages))
+			stats = hub.RequestChatCompletions(chatReq, key, affinity, ow, r.Context())
+		}
+		release(stats.CompletionTokens)
+
+		return req.Model
+	}))
+
+	// Handle the Ollama chat endpoint
+	mux.HandleFunc("/api/chat", hub.instrument(func(w http.ResponseWriter, r *http.Request) string {
+		ow := newOllamaWriter(w, true)
+		if !hub.admit(ow) {
+			ow.finish()
+			return ""
+		}
+		defer hub.endRequest()
+		defer ow.finish()
+
+		key, ok := hub.authenticate(ow, r)
+		if !ok {
+			return ""
+		}
+
+		// Parse the chat request
+		req := message.OllamaChatRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(ow, "Failed to parse request", http.StatusBadRequest)
+			return ""
+		}
+		ow.model = req.Model
+		ow.stream = ollamaStream(req.Stream)
+		if !authorizeModel(ow, key, req.Model) {
+			return req.Model
+		}
+		release, ok := hub.limit(ow, r, key)
+		if !ok {
+			return req.Model
+		}
+
+		// Request chat completions from the workers
+		chatReq := ollamaChatRequest(req.Model, req.Messages, req.Stream, req.Options)
+		affinity := hub.affinityKey(r, "", chatPrefix(chatReq.Messages))
+		stats := hub.RequestChatCompletions(chatReq, key, affinity, ow, r.Context())
+		release(stats.CompletionTokens)
+
+		return req.Model
+	}))
+
+	// Handle the Ollama list models endpoint
+	mux.HandleFunc("/api/tags", func(w http.ResponseWriter, r *http.Request) {
+		// Report authentication failures as Ollama errors
+		ow := newOllamaWriter(w, false)
+		key, ok := hub.authenticate(ow, r)
+		if !ok {
+			ow.finish()
+			return
+		}
+
+		// Only list the models the key has access to
+		models := make([]message.Model, 0)
+		for _, model := range append(hub.GetAllModels(), hub.aliasModels()...) {
+			if key.AllowsModel(model.Id) {
+				models = append(models, model)
+			}
+		}
+		json.NewEncoder(w).Encode(ollamaTags(models))
 	})
 
+	// Handle the embeddings endpoint
+	mux.HandleFunc("/v1/embeddings", hub.instrument(hub.accept(func(w http.ResponseWriter, r *http.Request) string {
+		key, ok := hub.authenticate(w, r)
+		if !ok {
+			return ""
+		}
+
+		// Parse the embeddings request
+		req := message.EmbeddingsRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Failed to parse request", http.StatusBadRequest)
+			return ""
+		}
+		if !authorizeModel(w, key, req.Model) {
+			return req.Model
+		}
+		release, ok := hub.limit(w, r, key)
+		if !ok {
+			return req.Model
+		}
+
+		// Request embeddings from the workers
+		stats := hub.RequestEmbeddings(req, key, w, r.Context())
+		release(stats.CompletionTokens)
+
+		return req.Model
+	})))
+
 	// Handle the list models endpoint
 	mux.HandleFunc("/v1/models", func(w http.ResponseWriter, r *http.Request) {
+		key, ok := hub.authenticate(w, r)
+		if !ok {
+			return
+		}
+
+		// Only list the models the key has access to
+		models := make([]message.Model, 0)
+		for _, model := range append(hub.GetAllModels(), hub.aliasModels()...) {
+			if key.AllowsModel(model.Id) {
+				models = append(models, model)
+			}
+		}
+
 		resp := message.ListModelsResponse{
 			Object: "list",
-			Data:   hub.GetAllModels(),
+			Data:   models,
 		}
 		json.NewEncoder(w).Encode(resp)
 	})
 
+	// Handle the metrics endpoint
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		hub.writeMetrics(w)
+	})
+
 	// Handle the worker websocket endpoint
 	mux.HandleFunc("/internal/v1/worker/ws", func(w http.ResponseWriter, r *http.Request) {
 		handleWorkerWS(&hub, w, r)
 	})
 
+	// List the workers, which requires an admin token if the admin API is
+	// enabled. Without one, the list is only served if API keys are disabled,
+	// as it would expose the models the keys are restricted from.
 	mux.HandleFunc("/internal/v1/workers", func(w http.ResponseWriter, r *http.Request) {
+		if len(hub.adminTokens) > 0 {
+			if !hub.authenticateAdmin(w, r) {
+				return
+			}
+		} else if len(hub.apiKeys) > 0 {
+			writeError(w, http.StatusNotFound, "invalid_request_error", "admin_api_disabled",
+				"Listing workers requires the admin API to be enabled.")
+			return
+		}
 		json.NewEncoder(w).Encode(hub.GetWorkers())
 	})
 
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
+	// Admin API
+	if len(hub.adminTokens) > 0 {
+		hub.registerAdminRoutes(mux)
+	}
 
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
 
 	server := &http.Server{
 		ReadHeaderTimeout: 10 * time.Second,
@@ -92,23 +446,42 @@ func RunServer(opts *ServerOpts, ctx context.Context) error {
 		cancel()
 	}()
 
-	for {
+	select {
+	case <-interrupt:
+	case <-ctx.Done():
+	}
+	log.Println("interrupt")
+
+	// Reject new requests and let the ones in progress complete, unless
+	// interrupted again
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), opts.ShutdownTimeout)
+	defer cancelDrain()
+	go func() {
 		select {
 		case <-interrupt:
-			cancel()
-
-		case <-ctx.Done():
-			log.Println("interrupt")
+			log.Println("interrupt, shutting down now")
+			cancelDrain()
+		case <-drainCtx.Done():
+		}
+	}()
+	if !hub.drainRequests(drainCtx) {
+		log.Println("Shutdown timeout reached with requests in progress")
+	}
+	cancel()
 
-			// Close the server
-			ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
-			defer cancel()
-			if err := server.Shutdown(ctx); err != nil {
-				log.Println("shutdown:", err)
-				return err
-			}
+	// Let the workers know so that they reconnect once the server is back
+	hub.notifyShutdown(time.Second)
 
-			return nil
-		}
+	// Close the server
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), time.Second)
+	defer cancelShutdown()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Println("shutdown:", err)
 	}
+
+	// Websocket connections are not closed by Shutdown, disconnect the
+	// remaining workers
+	hub.CloseWorkers()
+
+	return nil
 }
@@ -0,0 +1,111 @@
+package hub
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/hizkifw/lmrouter/message"
+)
+
+// beginRequest registers a client request in progress. It returns false if
+// the hub is shutting down and no longer accepts requests.
+func (h *Hub) beginRequest() bool {
+	h.shutdownLock.Lock()
+	defer h.shutdownLock.Unlock()
+
+	if h.shuttingDown {
+		return false
+	}
+	h.activeRequests++
+	return true
+}
+
+// endRequest marks a request registered with beginRequest as completed.
+func (h *Hub) endRequest() {
+	h.shutdownLock.Lock()
+	defer h.shutdownLock.Unlock()
+
+	h.activeRequests--
+	if h.activeRequests == 0 && h.idle != nil {
+		close(h.idle)
+		h.idle = nil
+	}
+}
+
+// admit registers a request in progress like beginRequest, rejecting it with
+// a 503 written to w if the hub is shutting down. Handlers translating their
+// responses to another API call it with their translating writer, so that the
+// error is translated too.
+func (h *Hub) admit(w http.ResponseWriter) bool {
+	if !h.beginRequest() {
+		w.Header().Set("Connection", "close")
+		writeError(w, http.StatusServiceUnavailable, "server_error", "server_shutting_down",
+			"The server is shutting down, please retry.")
+		return false
+	}
+	return true
+}
+
+// accept wraps a handler to reject requests with a 503 once the hub is
+// shutting down, and to keep track of the ones in progress.
+func (h *Hub) accept(handler func(w http.ResponseWriter, r *http.Request) string) func(w http.ResponseWriter, r *http.Request) string {
+	return func(w http.ResponseWriter, r *http.Request) string {
+		if !h.admit(w) {
+			return ""
+		}
+		defer h.endRequest()
+
+		return handler(w, r)
+	}
+}
+
+// drainRequests stops accepting new requests and waits for the ones in
+// progress to complete, returning false if ctx is done first.
+func (h *Hub) drainRequests(ctx context.Context) bool {
+	h.shutdownLock.Lock()
+	h.shuttingDown = true
+	if h.activeRequests == 0 {
+		h.shutdownLock.Unlock()
+		return true
+	}
+	if h.idle == nil {
+		h.idle = make(chan struct{})
+	}
+	idle := h.idle
+	log.Printf("Waiting for %d requests in progress to complete", h.activeRequests)
+	h.shutdownLock.Unlock()
+
+	select {
+	case <-idle:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// notifyShutdown tells the workers that the hub is going away, so that they
+// reconnect rather than treat it as a failure, and waits up to timeout for
+// them to disconnect.
+func (h *Hub) notifyShutdown(timeout time.Duration) {
+	workers := h.GetWorkers()
+	for _, worker := range workers {
+		_, err := message.Send[string](worker.mbuf, &message.TypedMessage[string]{
+			Type:    message.MTServerShutdown,
+			Message: "shutdown",
+		})
+		if err != nil {
+			log.Printf("Failed to notify worker %v of shutdown: %v", worker.Id, err)
+		}
+	}
+
+	deadline := time.After(timeout)
+	for _, worker := range workers {
+		select {
+		case <-worker.mbuf.Done():
+		case <-deadline:
+			return
+		}
+	}
+}
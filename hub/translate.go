@@ -0,0 +1,90 @@
+package hub
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/hizkifw/lmrouter/message"
+)
+
+// errorMessage extracts the message of an error body written by the hub or
+// relayed from a worker, which is either an OpenAI error or plain text.
+func errorMessage(status int, body []byte) string {
+	var errResp message.ErrorResponse
+	if err := json.Unmarshal(body, &errResp); err == nil && errResp.Error.Message != "" {
+		return errResp.Error.Message
+	}
+	if msg := strings.TrimSpace(string(body)); msg != "" {
+		return msg
+	}
+	return http.StatusText(status)
+}
+
+// translatingWriter collects the OpenAI responses a worker writes to the client
+// so that they can be translated into the format of another API. Streamed SSE
+// events are passed to onEvent as they complete, while other responses and
+// errors are buffered for the translation to handle once the request is done.
+type translatingWriter struct {
+	http.ResponseWriter
+
+	// stream is set once the request is known to be a streaming one
+	stream bool
+
+	status  int
+	buf     bytes.Buffer
+	onEvent func(data []byte, isError bool)
+}
+
+func newTranslatingWriter(w http.ResponseWriter, onEvent func(data []byte, isError bool)) *translatingWriter {
+	return &translatingWriter{ResponseWriter: w, onEvent: onEvent}
+}
+
+// streaming reports whether a successful stream is being relayed.
+func (w *translatingWriter) streaming() bool {
+	return w.stream && w.status == http.StatusOK
+}
+
+func (w *translatingWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+	if w.streaming() {
+		w.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (w *translatingWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.buf.Write(p)
+
+	// Translate each complete SSE event
+	for w.streaming() {
+		event, _, ok := bytes.Cut(w.buf.Bytes(), []byte("\n\n"))
+		if !ok {
+			break
+		}
+		isError := false
+		var data []byte
+		for _, line := range bytes.Split(event, []byte("\n")) {
+			if bytes.Equal(line, []byte("event: error")) {
+				isError = true
+			} else if d, ok := bytes.CutPrefix(line, []byte("data: ")); ok {
+				data = d
+			}
+		}
+		w.onEvent(data, isError)
+		w.buf.Next(len(event) + 2)
+	}
+	return len(p), nil
+}
+
+func (w *translatingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok && w.streaming() {
+		f.Flush()
+	}
+}
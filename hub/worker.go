@@ -3,33 +3,114 @@ package hub
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/hizkifw/lmrouter/message"
 )
 
+// drainTimeout is how long to wait for a worker to acknowledge a cancelled
+// request before giving up on its remaining replies.
+const drainTimeout = 30 * time.Second
+
+// errWorkerLost is returned when the connection to a worker is lost while it
+// is serving a request.
+var errWorkerLost = errors.New("lost connection to worker")
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
 }
 
 type Worker struct {
-	Id   uuid.UUID          `json:"id"`
-	Info message.WorkerInfo `json:"info"`
+	Id uuid.UUID `json:"id"`
+
+	// Info is the information advertised by the worker. It may be updated
+	// while the worker is connected, use GetInfo to read it.
+	Info     message.WorkerInfo `json:"info"`
+	infoLock sync.RWMutex
 
 	conn            *websocket.Conn
 	mbuf            *message.MessageBuffer
+	connectedAt     time.Time
 	activeTasks     int
+	totalTasks      uint64
 	activeTasksLock sync.Mutex
+	pingRTT         time.Duration
+	pingRTTLock     sync.Mutex
+	latency         LatencyStats
+	latencyLock     sync.Mutex
+
+	// draining workers are not given new requests, and weight scales how
+	// many requests the worker is given relative to others
+	draining  bool
+	weight    float64
+	stateLock sync.Mutex
+}
+
+func (w *Worker) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Id       uuid.UUID          `json:"id"`
+		Info     message.WorkerInfo `json:"info"`
+		Draining bool               `json:"draining"`
+	}{
+		Id:       w.Id,
+		Info:     w.GetInfo(),
+		Draining: w.IsDraining(),
+	})
+}
+
+// IsDraining reports whether the worker is no longer accepting new requests.
+func (w *Worker) IsDraining() bool {
+	w.stateLock.Lock()
+	defer w.stateLock.Unlock()
+	return w.draining
+}
+
+func (w *Worker) setDraining(draining bool) {
+	w.stateLock.Lock()
+	defer w.stateLock.Unlock()
+	w.draining = draining
+}
+
+// GetWeight returns the routing weight of the worker, 1 by default.
+func (w *Worker) GetWeight() float64 {
+	w.stateLock.Lock()
+	defer w.stateLock.Unlock()
+	if w.weight <= 0 {
+		return 1
+	}
+	return w.weight
+}
+
+func (w *Worker) setWeight(weight float64) {
+	w.stateLock.Lock()
+	defer w.stateLock.Unlock()
+	w.weight = weight
+}
+
+// GetInfo returns the information currently advertised by the worker.
+func (w *Worker) GetInfo() message.WorkerInfo {
+	w.infoLock.RLock()
+	defer w.infoLock.RUnlock()
+	return w.Info
+}
+
+// setInfo replaces the information advertised by the worker.
+func (w *Worker) setInfo(info message.WorkerInfo) {
+	w.infoLock.Lock()
+	defer w.infoLock.Unlock()
+	w.Info = info
 }
 
 func (w *Worker) HasModel(modelId string) bool {
-	for _, model := range w.Info.AvailableModels {
+	for _, model := range w.GetInfo().AvailableModels {
 		if model.Id == modelId {
 			return true
 		}
@@ -43,29 +124,187 @@ func (w *Worker) GetActiveTasks() int {
 	return w.activeTasks
 }
 
-func (w *Worker) RequestCompletions(cr message.CompletionsRequest, wr http.ResponseWriter, ctx context.Context) error {
+// GetTotalTasks returns the number of requests the worker was given since it
+// connected.
+func (w *Worker) GetTotalTasks() uint64 {
+	w.activeTasksLock.Lock()
+	defer w.activeTasksLock.Unlock()
+	return w.totalTasks
+}
+
+// GetPingRTT returns the round trip time of the last ping to the worker.
+func (w *Worker) GetPingRTT() time.Duration {
+	w.pingRTTLock.Lock()
+	defer w.pingRTTLock.Unlock()
+	return w.pingRTT
+}
+
+func (w *Worker) setPingRTT(rtt time.Duration) {
+	w.pingRTTLock.Lock()
+	defer w.pingRTTLock.Unlock()
+	w.pingRTT = rtt
+}
+
+// Load returns how busy the worker is as the fraction of its slots in use.
+// Workers that did not advertise their number of slots are counted as having
+// a single one, so that they are preferred only while idle.
+func (w *Worker) Load() float64 {
+	slots := w.GetInfo().MaxConcurrency
+
+	w.activeTasksLock.Lock()
+	defer w.activeTasksLock.Unlock()
+
+	if slots <= 0 {
+		return float64(w.activeTasks)
+	}
+	return float64(w.activeTasks) / float64(slots)
+}
+
+// HasCapacity reports whether the worker can take on another task.
+func (w *Worker) HasCapacity() bool {
+	slots := w.GetInfo().MaxConcurrency
+
 	w.activeTasksLock.Lock()
+	defer w.activeTasksLock.Unlock()
+	return slots <= 0 || w.activeTasks < slots
+}
+
+// reserve takes a task slot on the worker if it has capacity left.
+func (w *Worker) reserve() bool {
+	slots := w.GetInfo().MaxConcurrency
+
+	w.activeTasksLock.Lock()
+	defer w.activeTasksLock.Unlock()
+
+	if slots > 0 && w.activeTasks >= slots {
+		return false
+	}
 	w.activeTasks++
-	w.activeTasksLock.Unlock()
+	w.totalTasks++
+	return true
+}
+
+// release frees a task slot taken by reserve.
+func (w *Worker) release() {
+	w.activeTasksLock.Lock()
+	defer w.activeTasksLock.Unlock()
+	w.activeTasks--
+}
+
+// RequestStats describes how a request was served by a worker.
+type RequestStats struct {
+	// Chunks is the number of response messages relayed to the client
+	Chunks int
+
+	// CompletionTokens is the number of tokens generated, as reported by the
+	// inference server or estimated from the number of streamed chunks
+	CompletionTokens int
+
+	// TimeToFirstToken is the time until the first chunk was received
+	TimeToFirstToken time.Duration
+
+	// Duration is the time until the last chunk was received
+	Duration time.Duration
+
+	// Failed is set if the worker reported a server error
+	Failed bool
+}
+
+// observe updates the stats with a response message from the worker.
+func (s *RequestStats) observe(msg json.RawMessage) {
+	s.Chunks++
+
+	var resp struct {
+		Usage *message.CompletionsUsage `json:"usage"`
+	}
+	if err := json.Unmarshal(msg, &resp); err == nil && resp.Usage != nil {
+		s.CompletionTokens = resp.Usage.CompletionTokens
+	} else if s.CompletionTokens < s.Chunks {
+		s.CompletionTokens = s.Chunks
+	}
+}
+
+// RequestCompletions requests completions from the worker, reporting the model
+// as clientModel in the responses if it differs from the one requested.
+func (w *Worker) RequestCompletions(cr message.CompletionsRequest, clientModel string, wr http.ResponseWriter, ctx context.Context) (RequestStats, error) {
+	return w.request(message.MTCompletionsRequest, cr, cr.Stream, rewriteModel(cr.Model, clientModel), wr, ctx)
+}
+
+// RequestChatCompletions requests chat completions from the worker, reporting
+// the model as clientModel in the responses if it differs from the one
+// requested.
+func (w *Worker) RequestChatCompletions(cr message.ChatCompletionsRequest, clientModel string, wr http.ResponseWriter, ctx context.Context) (RequestStats, error) {
+	return w.request(message.MTChatCompletionsRequest, cr, cr.Stream, rewriteModel(cr.Model, clientModel), wr, ctx)
+}
+
+// RequestEmbeddings requests embeddings from the worker, reporting the model as
+// clientModel in the response if it differs from the one requested.
+func (w *Worker) RequestEmbeddings(er message.EmbeddingsRequest, clientModel string, wr http.ResponseWriter, ctx context.Context) (RequestStats, error) {
+	return w.request(message.MTEmbeddingsRequest, er, false, rewriteModel(er.Model, clientModel), wr, ctx)
+}
+
+// rewriteModel returns a function replacing the model of a response with the
+// one the client asked for, or nil if they are the same.
+func rewriteModel(workerModel string, clientModel string) func(json.RawMessage) json.RawMessage {
+	if clientModel == "" || clientModel == workerModel {
+		return nil
+	}
+
+	model, _ := json.Marshal(clientModel)
+	return func(msg json.RawMessage) json.RawMessage {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(msg, &fields); err != nil {
+			return msg
+		}
+		if _, ok := fields["model"]; !ok {
+			return msg
+		}
+		fields["model"] = model
+		rewritten, err := json.Marshal(fields)
+		if err != nil {
+			return msg
+		}
+		return rewritten
+	}
+}
+
+// request sends an inference request of the given type to the worker and
+// relays the response back to the HTTP client, either as a single JSON body or
+// as a stream of server-sent events, passing each message through rewrite if
+// set. The caller is expected to have reserved a task slot on the worker.
+//
+// If the connection to the worker is lost, an error wrapping errWorkerLost is
+// returned. Nothing has been written to the client if stats.Chunks is zero, so
+// the request can be retried elsewhere. Otherwise the stream is terminated
+// with an error event.
+func (w *Worker) request(
+	typ message.MessageType, payload any, stream bool, rewrite func(json.RawMessage) json.RawMessage,
+	wr http.ResponseWriter, ctx context.Context,
+) (stats RequestStats, err error) {
+	start := time.Now()
 	defer func() {
-		w.activeTasksLock.Lock()
-		w.activeTasks--
-		w.activeTasksLock.Unlock()
+		stats.Duration = time.Since(start)
 	}()
 
+	// Subscribe to replies before sending the request so none are missed
+	id := message.NewId()
+	sub := w.mbuf.SubscribeId(id)
+	defer sub.Close()
+
 	// Request completions from the worker
-	id, err := message.Send[message.CompletionsRequest](w.mbuf, &message.TypedMessage[message.CompletionsRequest]{
-		Type:    message.MTCompletionsRequest,
-		Message: cr,
+	_, err = message.Send[any](w.mbuf, &message.TypedMessage[any]{
+		Type:    typ,
+		Id:      id,
+		Message: payload,
 	})
 	if err != nil {
-		return fmt.Errorf("failed to send completions request to worker: %w", err)
+		return stats, fmt.Errorf("%w: failed to send %s: %w", errWorkerLost, typ, err)
 	}
-	log.Printf("Sending completions request %s to worker %s", id, w.Id)
+	log.Printf("Sending %s %s to worker %s", typ, id, w.Id)
 
 	// Write headers
 	wr.Header().Set("Cache-Control", "no-cache")
-	if cr.Stream {
+	if stream {
 		wr.Header().Set("Content-Type", "text/event-stream")
 		wr.Header().Set("Connection", "keep-alive")
 	} else {
@@ -75,17 +314,42 @@ func (w *Worker) RequestCompletions(cr message.CompletionsRequest, wr http.Respo
 	// Wait for the response
 	processing := true
 	headersSent := false
+	var lastChunk json.RawMessage
 	for processing {
-		resp, err := message.ReceiveId[json.RawMessage](w.mbuf, id, ctx)
+		resp, err := message.Receive[json.RawMessage](sub, ctx)
 		if err != nil {
-			return fmt.Errorf("failed to read response from worker: %w", err)
+			if ctx.Err() != nil {
+				// Client went away, tell the worker to stop generating
+				w.cancelRequest(id)
+				w.drain(sub)
+				return stats, fmt.Errorf("failed to read response from worker: %w", err)
+			}
+
+			if headersSent {
+				// Too late to retry, let the client know the output is cut off
+				writeStreamInterrupted(wr, lastChunk)
+			}
+			return stats, fmt.Errorf("%w: failed to read response: %w", errWorkerLost, err)
 		}
 		if resp.Type == message.MTCompletionsDone {
-			return nil
+			return stats, nil
+		}
+		if resp.Type == message.MTCompletionsError {
+			status := writeCompletionsError(wr, resp.Message, stream && headersSent)
+			stats.Failed = status >= http.StatusInternalServerError
+			return stats, nil
 		}
 		if resp.Type != message.MTCompletionsResponse {
-			return fmt.Errorf("expected completions_response message, got %v", resp.Type)
+			return stats, fmt.Errorf("expected completions_response message, got %v", resp.Type)
+		}
+		if stats.Chunks == 0 {
+			stats.TimeToFirstToken = time.Since(start)
+		}
+		stats.observe(resp.Message)
+		if rewrite != nil {
+			resp.Message = rewrite(resp.Message)
 		}
+		lastChunk = resp.Message
 
 		// Write the response
 		if !headersSent {
@@ -93,13 +357,13 @@ func (w *Worker) RequestCompletions(cr message.CompletionsRequest, wr http.Respo
 			headersSent = true
 		}
 
-		if cr.Stream {
+		if stream {
 			wr.Write([]byte("data: "))
 		}
 
 		wr.Write(resp.Message)
 
-		if cr.Stream {
+		if stream {
 			wr.Write([]byte("\n\n"))
 			if f, ok := wr.(http.Flusher); ok {
 				f.Flush()
@@ -109,7 +373,116 @@ func (w *Worker) RequestCompletions(cr message.CompletionsRequest, wr http.Respo
 		}
 	}
 
-	return nil
+	return stats, nil
+}
+
+// cancelRequest asks the worker to abort the request with the given id.
+func (w *Worker) cancelRequest(id string) {
+	log.Printf("Cancelling request %s on worker %s", id, w.Id)
+	if _, err := message.Send[string](w.mbuf, &message.TypedMessage[string]{
+		Type:    message.MTCancel,
+		Id:      id,
+		Message: "cancel",
+	}); err != nil {
+		log.Printf("Failed to send cancel to worker %v: %v", w.Id, err)
+	}
+}
+
+// drain discards replies that are still in flight for a cancelled request
+// until the worker acknowledges the cancellation, so that they do not pile up
+// in the message buffer.
+func (w *Worker) drain(sub *message.Subscription) {
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+
+	for {
+		resp, err := message.Receive[json.RawMessage](sub, ctx)
+		if err != nil {
+			return
+		}
+		if resp.Type == message.MTCompletionsDone || resp.Type == message.MTCompletionsError {
+			return
+		}
+	}
+}
+
+// writeCompletionsError relays an error reported by the worker to the client,
+// returning its status code. If the stream has already started, the error is
+// sent as an SSE error event since the status code can no longer be changed.
+func writeCompletionsError(wr http.ResponseWriter, raw json.RawMessage, streaming bool) int {
+	var compErr message.CompletionsError
+	if err := json.Unmarshal(raw, &compErr); err != nil {
+		log.Printf("Failed to parse completions error: %v", err)
+		compErr.StatusCode = http.StatusBadGateway
+	}
+	if compErr.StatusCode == 0 {
+		compErr.StatusCode = http.StatusBadGateway
+	}
+	if len(compErr.Body) == 0 {
+		compErr.Body, _ = json.Marshal(message.ErrorResponse{
+			Error: message.ErrorDetail{
+				Message: http.StatusText(compErr.StatusCode),
+				Type:    "server_error",
+			},
+		})
+	}
+
+	if streaming {
+		wr.Write([]byte("event: error\ndata: "))
+		wr.Write(compErr.Body)
+		wr.Write([]byte("\n\n"))
+		if f, ok := wr.(http.Flusher); ok {
+			f.Flush()
+		}
+		return compErr.StatusCode
+	}
+
+	wr.Header().Set("Content-Type", "application/json")
+	wr.Header().Del("Connection")
+	wr.WriteHeader(compErr.StatusCode)
+	wr.Write(compErr.Body)
+	return compErr.StatusCode
+}
+
+// writeStreamInterrupted terminates a stream whose worker went away. It sends
+// a final chunk with an "error" finish reason, modelled after the last chunk
+// relayed, followed by an SSE error event.
+func writeStreamInterrupted(wr http.ResponseWriter, lastChunk json.RawMessage) {
+	var chunk struct {
+		Id      string `json:"id"`
+		Object  string `json:"object"`
+		Created int64  `json:"created"`
+		Model   string `json:"model"`
+	}
+	json.Unmarshal(lastChunk, &chunk)
+
+	choice := map[string]any{"index": 0, "finish_reason": "error"}
+	if chunk.Object == "chat.completion.chunk" {
+		choice["delta"] = map[string]any{}
+	} else {
+		choice["text"] = ""
+	}
+	final, _ := json.Marshal(map[string]any{
+		"id":      chunk.Id,
+		"object":  chunk.Object,
+		"created": chunk.Created,
+		"model":   chunk.Model,
+		"choices": []any{choice},
+	})
+	wr.Write([]byte("data: "))
+	wr.Write(final)
+	wr.Write([]byte("\n\n"))
+
+	code := "worker_disconnected"
+	body, _ := json.Marshal(message.ErrorResponse{
+		Error: message.ErrorDetail{
+			Message: "The worker serving this request disconnected before it completed",
+			Type:    "server_error",
+			Code:    &code,
+		},
+	})
+	raw, _ := json.Marshal(message.CompletionsError{StatusCode: http.StatusBadGateway, Body: body})
+	writeCompletionsError(wr, raw, true)
 }
 
 func handleWorkerWS(hub *Hub, w http.ResponseWriter, r *http.Request) {
@@ -148,13 +521,43 @@ func handleWorkerWS(hub *Hub, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Check the worker token, and make sure it is not exposed afterwards
+	if !hub.checkWorkerToken(info.Message.Token) {
+		log.Printf("Rejecting worker %q from %s: invalid token", info.Message.WorkerName, r.RemoteAddr)
+		message.Send[message.Ack](mb, &message.TypedMessage[message.Ack]{
+			Type:    message.MTAck,
+			Id:      info.Id,
+			Message: message.Ack{Ok: false, Message: "invalid worker token"},
+		})
+		mb.Close()
+		return
+	}
+	info.Message.Token = ""
+
+	// Turn away banned workers
+	if hub.isBanned(info.Message.WorkerName) {
+		log.Printf("Rejecting worker %q from %s: banned", info.Message.WorkerName, r.RemoteAddr)
+		message.Send[message.Ack](mb, &message.TypedMessage[message.Ack]{
+			Type:    message.MTAck,
+			Id:      info.Id,
+			Message: message.Ack{Ok: false, Message: "worker is banned"},
+		})
+		mb.Close()
+		return
+	}
+
 	// Register the worker
 	worker := &Worker{
-		Id:   uuid.New(),
-		Info: info.Message,
-		conn: conn,
-		mbuf: mb,
+		Id:          uuid.New(),
+		Info:        info.Message,
+		conn:        conn,
+		mbuf:        mb,
+		connectedAt: time.Now(),
 	}
+	updates := mb.SubscribeType(message.MTWorkerInfoUpdate)
+	go hub.watchWorkerInfo(worker, updates)
+	drains := mb.SubscribeType(message.MTWorkerDraining)
+	go hub.watchWorkerDraining(worker, drains)
 	hub.RegisterWorker(worker)
 
 	// Send the registration response
@@ -168,3 +571,46 @@ func handleWorkerWS(hub *Hub, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+// watchWorkerInfo applies the updated information announced by the worker,
+// for example when models are loaded or unloaded, until it disconnects.
+func (h *Hub) watchWorkerInfo(worker *Worker, updates *message.Subscription) {
+	defer updates.Close()
+	for {
+		update, err := message.Receive[message.WorkerInfo](updates, context.Background())
+		if err != nil {
+			return
+		}
+
+		// The worker name and token are fixed at registration
+		info := update.Message
+		info.WorkerName = worker.GetInfo().WorkerName
+		info.Token = ""
+		worker.setInfo(info)
+		log.Printf("Worker %v updated its info: %d models, %d slots",
+			worker.Id, len(info.AvailableModels), info.MaxConcurrency)
+
+		// Queued requests may be servable now
+		h.queue.wakeAll()
+	}
+}
+
+// watchWorkerDraining stops routing requests to the worker once it announces
+// that it is shutting down, until it disconnects.
+func (h *Hub) watchWorkerDraining(worker *Worker, drains *message.Subscription) {
+	defer drains.Close()
+	for {
+		msg, err := message.Receive[string](drains, context.Background())
+		if err != nil {
+			return
+		}
+
+		worker.setDraining(true)
+		log.Printf("Worker %v is draining", worker.Id)
+		message.Send[message.Ack](worker.mbuf, &message.TypedMessage[message.Ack]{
+			Type:    message.MTAck,
+			Id:      msg.Id,
+			Message: message.Ack{Ok: true, Message: "draining"},
+		})
+	}
+}
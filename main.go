@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/alexflint/go-arg"
 	"github.com/hizkifw/lmrouter/agent"
@@ -47,6 +49,11 @@ func main() {
 		opts := hub.ServerOpts{}
 		mustParseArgs(&opts)
 
+		// Drain on SIGTERM too, which is how service managers and container
+		// runtimes stop the hub
+		ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
 		if err := hub.RunServer(&opts, ctx); err != nil {
 			panic(err)
 		}
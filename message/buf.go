@@ -3,7 +3,9 @@ package message
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log"
+	"slices"
 	"sync"
 	"time"
 
@@ -11,59 +13,237 @@ import (
 	"github.com/gorilla/websocket"
 )
 
+// closeTimeout is how long to wait for the peer to acknowledge a close.
+const closeTimeout = time.Second
+
+// ErrClosed is returned when receiving from a closed MessageBuffer.
+var ErrClosed = errors.New("message buffer closed")
+
 func NewId() string {
 	return uuid.New().String()
 }
 
+// MessageBuffer reads messages from a websocket connection and dispatches them
+// to subscribers. A message is delivered to the subscriber for its id if there
+// is one, otherwise to the subscriber for its type. Messages that have no
+// subscriber yet are held until one subscribes, except for replies: those are
+// only expected by a subscriber for their id, which must subscribe before
+// sending the message they reply to, so replies that have none are dropped.
 type MessageBuffer struct {
-	conn       *websocket.Conn
-	recvBuffer map[string]*TypedMessage[json.RawMessage]
-	recvLock   sync.Mutex
-	sendLock   sync.Mutex
-	bufferLock sync.Mutex
+	conn     *websocket.Conn
+	sendLock sync.Mutex
+
+	lock     sync.Mutex
+	pending  []*TypedMessage[json.RawMessage]
+	idSubs   map[string]*Subscription
+	typeSubs map[MessageType]*Subscription
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Subscription receives messages matching an id or a type, in the order they
+// arrived on the connection.
+type Subscription struct {
+	mb     *MessageBuffer
+	id     string
+	types  []MessageType
+	queue  []*TypedMessage[json.RawMessage]
+	notify chan struct{}
 }
 
 func NewMessageBuffer(conn *websocket.Conn) *MessageBuffer {
 	return &MessageBuffer{
-		conn:       conn,
-		recvBuffer: make(map[string]*TypedMessage[json.RawMessage]),
+		conn:     conn,
+		idSubs:   make(map[string]*Subscription),
+		typeSubs: make(map[MessageType]*Subscription),
+		closed:   make(chan struct{}),
 	}
 }
 
 func (mb *MessageBuffer) RecvLoop() {
+	defer mb.markClosed()
+
 	for {
-		msg, err := receive[json.RawMessage](mb)
-		if err != nil {
+		var msg TypedMessage[json.RawMessage]
+		if err := mb.conn.ReadJSON(&msg); err != nil {
 			log.Printf("failed to receive message: %v", err)
 			return
 		}
 
-		for !mb.tryInsert(msg) {
-			time.Sleep(time.Millisecond)
-		}
+		mb.dispatch(&msg)
 	}
 }
 
-func (mb *MessageBuffer) tryInsert(msg *TypedMessage[json.RawMessage]) bool {
-	mb.bufferLock.Lock()
-	defer mb.bufferLock.Unlock()
-	if _, ok := mb.recvBuffer[msg.Id]; ok {
+func (mb *MessageBuffer) dispatch(msg *TypedMessage[json.RawMessage]) {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+	mb.dispatchLocked(msg)
+}
+
+// dispatchLocked is like dispatch but must be called with mb.lock held.
+func (mb *MessageBuffer) dispatchLocked(msg *TypedMessage[json.RawMessage]) {
+	if sub, ok := mb.idSubs[msg.Id]; ok {
+		sub.push(msg)
+	} else if sub, ok := mb.typeSubs[msg.Type]; ok {
+		sub.push(msg)
+	} else if !isReply(msg.Type) {
+		mb.pending = append(mb.pending, msg)
+	}
+}
+
+// isReply reports whether messages of the given type are replies to another
+// message, sharing its id.
+func isReply(typ MessageType) bool {
+	switch typ {
+	case MTAck, MTCompletionsResponse, MTCompletionsDone, MTCompletionsError:
+		return true
+	default:
 		return false
 	}
-	mb.recvBuffer[msg.Id] = msg
-	return true
 }
 
+// Done returns a channel that is closed once the buffer stops receiving.
+func (mb *MessageBuffer) Done() <-chan struct{} {
+	return mb.closed
+}
+
+func (mb *MessageBuffer) markClosed() {
+	mb.closeOnce.Do(func() {
+		close(mb.closed)
+	})
+}
+
+// Close sends a close message to the peer. The buffer is closed once the peer
+// acknowledges it, or after closeTimeout if it does not.
 func (mb *MessageBuffer) Close() error {
+	mb.sendLock.Lock()
 	err := mb.conn.WriteMessage(
 		websocket.CloseMessage,
 		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
 	)
+	mb.sendLock.Unlock()
+
+	if err != nil {
+		mb.markClosed()
+		return err
+	}
+
+	return mb.conn.SetReadDeadline(time.Now().Add(closeTimeout))
+}
+
+// SubscribeId subscribes to all messages with the given id. Subscribe before
+// sending a request to make sure no reply is missed.
+func (mb *MessageBuffer) SubscribeId(id string) *Subscription {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+
+	sub := mb.newSubscription(id, nil)
+	mb.idSubs[id] = sub
+	return sub
+}
 
-	mb.bufferLock.Lock()
-	mb.recvBuffer = nil
+// SubscribeType subscribes to all messages of the given types that do not have
+// a subscriber for their id. Messages of different types are received in the
+// order they arrived, so subscribe to them together when that order matters.
+func (mb *MessageBuffer) SubscribeType(types ...MessageType) *Subscription {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
 
-	return err
+	sub := mb.newSubscription("", types)
+	for _, typ := range types {
+		mb.typeSubs[typ] = sub
+	}
+	return sub
+}
+
+// newSubscription creates a subscription and claims any matching pending
+// messages. Must be called with mb.lock held.
+func (mb *MessageBuffer) newSubscription(id string, types []MessageType) *Subscription {
+	sub := &Subscription{
+		mb:     mb,
+		id:     id,
+		types:  types,
+		notify: make(chan struct{}, 1),
+	}
+
+	remaining := mb.pending[:0]
+	for _, msg := range mb.pending {
+		if sub.matches(msg) {
+			sub.push(msg)
+		} else {
+			remaining = append(remaining, msg)
+		}
+	}
+	clear(mb.pending[len(remaining):])
+	mb.pending = remaining
+
+	return sub
+}
+
+func (sub *Subscription) matches(msg *TypedMessage[json.RawMessage]) bool {
+	if sub.id != "" {
+		return msg.Id == sub.id
+	}
+	return slices.Contains(sub.types, msg.Type)
+}
+
+// push queues a message on the subscription. Must be called with mb.lock held.
+func (sub *Subscription) push(msg *TypedMessage[json.RawMessage]) {
+	sub.queue = append(sub.queue, msg)
+	select {
+	case sub.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Close removes the subscription. Messages that were queued but not received
+// are handed back to the buffer for other subscribers, and replies still
+// arriving for a closed id subscription are dropped.
+func (sub *Subscription) Close() {
+	mb := sub.mb
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+
+	if sub.id != "" {
+		if mb.idSubs[sub.id] == sub {
+			delete(mb.idSubs, sub.id)
+		}
+	} else {
+		for _, typ := range sub.types {
+			if mb.typeSubs[typ] == sub {
+				delete(mb.typeSubs, typ)
+			}
+		}
+	}
+
+	queue := sub.queue
+	sub.queue = nil
+	for _, msg := range queue {
+		mb.dispatchLocked(msg)
+	}
+}
+
+func (sub *Subscription) next(ctx context.Context) (*TypedMessage[json.RawMessage], error) {
+	for {
+		sub.mb.lock.Lock()
+		if len(sub.queue) > 0 {
+			msg := sub.queue[0]
+			sub.queue[0] = nil
+			sub.queue = sub.queue[1:]
+			sub.mb.lock.Unlock()
+			return msg, nil
+		}
+		sub.mb.lock.Unlock()
+
+		select {
+		case <-sub.notify:
+		case <-sub.mb.closed:
+			return nil, ErrClosed
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
 }
 
 func Send[T any](mb *MessageBuffer, msg *TypedMessage[T]) (string, error) {
@@ -89,52 +269,17 @@ func castMessage[T any](msg *TypedMessage[json.RawMessage]) *TypedMessage[T] {
 	return m
 }
 
-func receive[T any](mb *MessageBuffer) (*TypedMessage[T], error) {
-	var msg TypedMessage[T]
-
-	mb.recvLock.Lock()
-	defer mb.recvLock.Unlock()
-
-	if err := mb.conn.ReadJSON(&msg); err != nil {
+// Receive waits for the next message on the subscription.
+func Receive[T any](sub *Subscription, ctx context.Context) (*TypedMessage[T], error) {
+	msg, err := sub.next(ctx)
+	if err != nil {
 		return nil, err
 	}
-	return &msg, nil
+	return castMessage[T](msg), nil
 }
 
 func ReceiveType[T any](mb *MessageBuffer, typ MessageType, ctx context.Context) (*TypedMessage[T], error) {
-	for {
-		mb.bufferLock.Lock()
-		for id, msg := range mb.recvBuffer {
-			if msg.Type == typ {
-				delete(mb.recvBuffer, id)
-				mb.bufferLock.Unlock()
-				return castMessage[T](msg), nil
-			}
-		}
-		mb.bufferLock.Unlock()
-
-		if ctx.Err() != nil {
-			return nil, ctx.Err()
-		}
-
-		time.Sleep(time.Millisecond)
-	}
-}
-
-func ReceiveId[T any](mb *MessageBuffer, id string, ctx context.Context) (*TypedMessage[T], error) {
-	for {
-		mb.bufferLock.Lock()
-		if msg, ok := mb.recvBuffer[id]; ok {
-			delete(mb.recvBuffer, id)
-			mb.bufferLock.Unlock()
-			return castMessage[T](msg), nil
-		}
-		mb.bufferLock.Unlock()
-
-		if ctx.Err() != nil {
-			return nil, ctx.Err()
-		}
-
-		time.Sleep(time.Millisecond)
-	}
+	sub := mb.SubscribeType(typ)
+	defer sub.Close()
+	return Receive[T](sub, ctx)
 }
@@ -47,8 +47,92 @@ type ListModelsResponse struct {
 }
 
 type Model struct {
-	Id      string `json:"id"`
-	Object  string `json:"object"`
-	Created int    `json:"created"`
-	OwnedBy string `json:"owned_by"`
+	Id             string `json:"id"`
+	Object         string `json:"object"`
+	Created        int    `json:"created"`
+	OwnedBy        string `json:"owned_by"`
+	EmbeddingsOnly bool   `json:"embeddings_only,omitempty"`
+}
+
+type ChatCompletionsRequest struct {
+	Model            string              `json:"model"`
+	Messages         []ChatMessage       `json:"messages"`
+	FrequencyPenalty *float32            `json:"frequency_penalty,omitempty"`
+	LogitBias        *map[string]float32 `json:"logit_bias,omitempty"`
+	Logprobs         *bool               `json:"logprobs,omitempty"`
+	TopLogprobs      *int                `json:"top_logprobs,omitempty"`
+	MaxTokens        *int                `json:"max_tokens,omitempty"`
+	N                *int                `json:"n,omitempty"`
+	PresencePenalty  *float32            `json:"presence_penalty,omitempty"`
+	ResponseFormat   *interface{}        `json:"response_format,omitempty"`
+	Seed             *int                `json:"seed,omitempty"`
+	Stop             *interface{}        `json:"stop,omitempty"`
+	Stream           bool                `json:"stream"`
+	Temperature      *float32            `json:"temperature,omitempty"`
+	TopP             *float32            `json:"top_p,omitempty"`
+	Tools            *interface{}        `json:"tools,omitempty"`
+	ToolChoice       *interface{}        `json:"tool_choice,omitempty"`
+	User             string              `json:"user,omitempty"`
+}
+
+type ChatMessage struct {
+	Role       string       `json:"role,omitempty"`
+	Content    interface{}  `json:"content,omitempty"`
+	Name       *string      `json:"name,omitempty"`
+	ToolCalls  *interface{} `json:"tool_calls,omitempty"`
+	ToolCallId *string      `json:"tool_call_id,omitempty"`
+}
+
+type ChatCompletionsResponse struct {
+	ID                string                  `json:"id"`
+	Object            string                  `json:"object"`
+	Created           int64                   `json:"created"`
+	Model             string                  `json:"model"`
+	SystemFingerprint *string                 `json:"system_fingerprint,omitempty"`
+	Choices           []ChatCompletionsChoice `json:"choices"`
+	Usage             *CompletionsUsage       `json:"usage,omitempty"`
+}
+
+type ChatCompletionsChoice struct {
+	Index        int          `json:"index"`
+	FinishReason *string      `json:"finish_reason"`
+	Message      *ChatMessage `json:"message,omitempty"`
+	Delta        *ChatMessage `json:"delta,omitempty"`
+}
+
+type EmbeddingsRequest struct {
+	Model          string      `json:"model"`
+	Input          interface{} `json:"input"`
+	EncodingFormat *string     `json:"encoding_format,omitempty"`
+	Dimensions     *int        `json:"dimensions,omitempty"`
+	User           string      `json:"user,omitempty"`
+}
+
+type EmbeddingsResponse struct {
+	Object string           `json:"object"`
+	Data   []Embedding      `json:"data"`
+	Model  string           `json:"model"`
+	Usage  *EmbeddingsUsage `json:"usage,omitempty"`
+}
+
+type Embedding struct {
+	Object    string      `json:"object"`
+	Index     int         `json:"index"`
+	Embedding interface{} `json:"embedding"`
+}
+
+type EmbeddingsUsage struct {
+	PromptTokens int `json:"prompt_tokens"`
+	TotalTokens  int `json:"total_tokens"`
+}
+
+type ErrorResponse struct {
+	Error ErrorDetail `json:"error"`
+}
+
+type ErrorDetail struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    *string `json:"code"`
 }
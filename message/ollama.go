@@ -0,0 +1,69 @@
+package message
+
+type OllamaGenerateRequest struct {
+	Model   string         `json:"model"`
+	Prompt  string         `json:"prompt"`
+	Suffix  string         `json:"suffix,omitempty"`
+	System  string         `json:"system,omitempty"`
+	Raw     bool           `json:"raw,omitempty"`
+	Stream  *bool          `json:"stream,omitempty"`
+	Options *OllamaOptions `json:"options,omitempty"`
+}
+
+type OllamaChatRequest struct {
+	Model    string          `json:"model"`
+	Messages []OllamaMessage `json:"messages"`
+	Stream   *bool           `json:"stream,omitempty"`
+	Options  *OllamaOptions  `json:"options,omitempty"`
+}
+
+type OllamaMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type OllamaOptions struct {
+	NumPredict  *int         `json:"num_predict,omitempty"`
+	Temperature *float32     `json:"temperature,omitempty"`
+	TopP        *float32     `json:"top_p,omitempty"`
+	Seed        *int         `json:"seed,omitempty"`
+	Stop        *interface{} `json:"stop,omitempty"`
+}
+
+type OllamaGenerateResponse struct {
+	Model     string `json:"model"`
+	CreatedAt string `json:"created_at"`
+	Response  string `json:"response"`
+	OllamaStats
+}
+
+type OllamaChatResponse struct {
+	Model     string        `json:"model"`
+	CreatedAt string        `json:"created_at"`
+	Message   OllamaMessage `json:"message"`
+	OllamaStats
+}
+
+type OllamaStats struct {
+	Done            bool   `json:"done"`
+	DoneReason      string `json:"done_reason,omitempty"`
+	TotalDuration   int64  `json:"total_duration,omitempty"`
+	PromptEvalCount int    `json:"prompt_eval_count,omitempty"`
+	EvalCount       int    `json:"eval_count,omitempty"`
+}
+
+type OllamaTagsResponse struct {
+	Models []OllamaModel `json:"models"`
+}
+
+type OllamaModel struct {
+	Name       string `json:"name"`
+	Model      string `json:"model"`
+	ModifiedAt string `json:"modified_at"`
+	Size       int64  `json:"size"`
+	Digest     string `json:"digest"`
+}
+
+type OllamaErrorResponse struct {
+	Error string `json:"error"`
+}
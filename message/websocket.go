@@ -1,5 +1,7 @@
 package message
 
+import "encoding/json"
+
 type MessageType string
 
 const (
@@ -7,9 +9,17 @@ const (
 	MTPing                MessageType = "ping"
 	MTServerInfo          MessageType = "server_info"
 	MTWorkerInfo          MessageType = "worker_info"
+	MTWorkerInfoUpdate    MessageType = "worker_info_update"
+	MTWorkerDraining      MessageType = "worker_draining"
 	MTCompletionsRequest  MessageType = "completions_request"
 	MTCompletionsResponse MessageType = "completions_response"
 	MTCompletionsDone     MessageType = "completions_done"
+	MTCompletionsError    MessageType = "completions_error"
+	MTCancel              MessageType = "cancel"
+	MTServerShutdown      MessageType = "server_shutdown"
+
+	MTChatCompletionsRequest MessageType = "chat_completions_request"
+	MTEmbeddingsRequest      MessageType = "embeddings_request"
 )
 
 type TypedMessage[T any] struct {
@@ -32,4 +42,19 @@ type ServerInfo struct {
 type WorkerInfo struct {
 	WorkerName      string  `json:"worker_name"`
 	AvailableModels []Model `json:"available_models"`
+
+	// MaxConcurrency is the number of requests the worker can process at
+	// once, i.e. its number of parallel slots, or 0 if unknown
+	MaxConcurrency int `json:"max_concurrency,omitempty"`
+
+	// Token is the shared secret used to authenticate the worker
+	Token string `json:"token,omitempty"`
+}
+
+type CompletionsError struct {
+	// StatusCode is the HTTP status code returned by the inference server
+	StatusCode int `json:"status_code"`
+
+	// Body is the OpenAI-style error body to relay to the client
+	Body json.RawMessage `json:"body"`
 }
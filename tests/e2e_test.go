@@ -5,11 +5,18 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/http/httputil"
 	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"strings"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
 
@@ -38,6 +45,11 @@ func dummyInferenceServer(addr string, ctx context.Context) {
 		json.NewEncoder(w).Encode(resp)
 	})
 
+	// Handle the llama.cpp properties endpoint
+	mux.HandleFunc("/props", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]int{"total_slots": 4})
+	})
+
 	// Handle the completions endpoint
 	mux.HandleFunc("/v1/completions", func(w http.ResponseWriter, r *http.Request) {
 		req := message.CompletionsRequest{}
@@ -46,6 +58,18 @@ func dummyInferenceServer(addr string, ctx context.Context) {
 			return
 		}
 
+		if req.MaxTokens != nil && *req.MaxTokens > 2048 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(message.ErrorResponse{
+				Error: message.ErrorDetail{
+					Message: "max_tokens too large",
+					Type:    "invalid_request_error",
+				},
+			})
+			return
+		}
+
 		finishReason := "length"
 
 		if !req.Stream {
@@ -96,6 +120,61 @@ func dummyInferenceServer(addr string, ctx context.Context) {
 		}
 	})
 
+	// Handle the chat completions endpoint
+	mux.HandleFunc("/v1/chat/completions", func(w http.ResponseWriter, r *http.Request) {
+		req := message.ChatCompletionsRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Failed to parse request", http.StatusBadRequest)
+			return
+		}
+
+		finishReason := "stop"
+
+		if !req.Stream {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(
+				message.ChatCompletionsResponse{
+					ID:      "chatcmpl-0000",
+					Object:  "chat.completion",
+					Created: (time.Now().UnixMilli()),
+					Choices: []message.ChatCompletionsChoice{
+						{
+							Index:        0,
+							FinishReason: &finishReason,
+							Message:      &message.ChatMessage{Role: "assistant", Content: "Hi there!"},
+						},
+					},
+					Model: "gpt-2",
+				})
+			return
+		}
+
+		// Streaming response
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		encoder := json.NewEncoder(w)
+		for _, token := range []string{"Hi", " there", "!"} {
+			w.Write([]byte("data: "))
+			encoder.Encode(message.ChatCompletionsResponse{
+				ID:      "chatcmpl-0000",
+				Object:  "chat.completion.chunk",
+				Created: (time.Now().UnixMilli()),
+				Choices: []message.ChatCompletionsChoice{
+					{
+						Index: 0,
+						Delta: &message.ChatMessage{Content: token},
+					},
+				},
+			})
+			w.Write([]byte("\n"))
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+		}
+		w.Write([]byte("data: [DONE]\n\n"))
+	})
+
 	server := &http.Server{
 		Addr:    addr,
 		Handler: mux,
@@ -153,9 +232,9 @@ func TestE2E(t *testing.T) {
 		defer wg.Done()
 		defer wgAgent.Done()
 		agent.RunAgent(&agent.AgentOpts{
-			HubAddr:       url.URL{Scheme: "ws", Host: hubListen},
-			InferenceAddr: url.URL{Scheme: "http", Host: inferenceListen},
-			WorkerName:    "test-worker",
+			HubAddr:    url.URL{Scheme: "ws", Host: hubListen},
+			Inference:  []agent.InferenceBackend{{Addr: url.URL{Scheme: "http", Host: inferenceListen}}},
+			WorkerName: "test-worker",
 		}, ctxAgent)
 	}()
 
@@ -169,6 +248,7 @@ func TestE2E(t *testing.T) {
 	assert.Len(workers, 1)
 	assert.Equal("test-worker", workers[0].Info.WorkerName)
 	assert.Len(workers[0].Info.AvailableModels, 1)
+	assert.Equal(4, workers[0].Info.MaxConcurrency)
 
 	// Test the models endpoint
 	resp, err = http.Get(hubUrl.JoinPath("/v1/models").String())
@@ -196,6 +276,18 @@ func TestE2E(t *testing.T) {
 	assert.NoError(err)
 	assert.Equal(http.StatusServiceUnavailable, resp.StatusCode)
 
+	// Backend errors should be relayed to the client
+	maxTokens := 4096
+	req = message.CompletionsRequest{Model: "gpt-2", Prompt: "Hello,", MaxTokens: &maxTokens}
+	enc, err = json.Marshal(req)
+	assert.NoError(err)
+	resp, err = http.Post(hubUrl.JoinPath("/v1/completions").String(), "application/json", bytes.NewReader(enc))
+	assert.NoError(err)
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+	var errResp message.ErrorResponse
+	assert.NoError(json.NewDecoder(resp.Body).Decode(&errResp))
+	assert.Equal("max_tokens too large", errResp.Error.Message)
+
 	// Streaming response should work
 	req = message.CompletionsRequest{Model: "gpt-2", Prompt: "lmrouter is", Stream: true}
 	enc, err = json.Marshal(req)
@@ -228,6 +320,56 @@ func TestE2E(t *testing.T) {
 	}
 	assert.Equal(6, parts)
 
+	// Test the chat completions endpoint
+	chatReq := message.ChatCompletionsRequest{
+		Model:    "gpt-2",
+		Messages: []message.ChatMessage{{Role: "user", Content: "Hello"}},
+	}
+	enc, err = json.Marshal(chatReq)
+	assert.NoError(err)
+	resp, err = http.Post(hubUrl.JoinPath("/v1/chat/completions").String(), "application/json", bytes.NewReader(enc))
+	assert.NoError(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	var chatResp message.ChatCompletionsResponse
+	assert.NoError(json.NewDecoder(resp.Body).Decode(&chatResp))
+	assert.Equal("Hi there!", chatResp.Choices[0].Message.Content)
+
+	// Streaming chat completions should work
+	chatReq.Stream = true
+	enc, err = json.Marshal(chatReq)
+	assert.NoError(err)
+	resp, err = http.Post(hubUrl.JoinPath("/v1/chat/completions").String(), "application/json", bytes.NewReader(enc))
+	assert.NoError(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	reader = bufio.NewReader(resp.Body)
+	content := ""
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(err)
+		if len(line) < 6 {
+			continue
+		}
+		assert.True(strings.HasPrefix(line, "data: "))
+		chunk := message.ChatCompletionsResponse{}
+		assert.NoError(json.Unmarshal([]byte(line[6:]), &chunk))
+		content += chunk.Choices[0].Delta.Content.(string)
+	}
+	assert.Equal("Hi there!", content)
+
+	// Metrics should reflect the requests made so far
+	resp, err = http.Get(hubUrl.JoinPath("/metrics").String())
+	assert.NoError(err)
+	metrics, err := io.ReadAll(resp.Body)
+	assert.NoError(err)
+	assert.Contains(string(metrics), `lmrouter_requests_total{model="gpt-2",status="200"} 4`)
+	assert.Contains(string(metrics), `lmrouter_requests_total{model="gpt-2",status="400"} 1`)
+	assert.Contains(string(metrics), `lmrouter_requests_total{model="other",status="503"} 1`)
+	assert.Contains(string(metrics), "lmrouter_connected_workers 1")
+	assert.Contains(string(metrics), `lmrouter_time_to_first_token_seconds_count{worker="test-worker"} 4`)
+
 	// Close the agent and test that it disconnected
 	cancelAgent()
 	wgAgent.Wait()
@@ -246,3 +388,2789 @@ func TestE2E(t *testing.T) {
 	cancel()
 	wg.Wait()
 }
+
+func TestAgentReconnect(t *testing.T) {
+	assert := assert.New(t)
+	wg := &sync.WaitGroup{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hubListen := "127.22.33.46:9090"
+	inferenceListen := "127.22.33.46:5000"
+	hubUrl := url.URL{Scheme: "http", Host: hubListen}
+
+	// Start the inference server
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		dummyInferenceServer(inferenceListen, ctx)
+	}()
+
+	// Start the agent before the hub is up
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		agent.RunAgent(&agent.AgentOpts{
+			HubAddr:      url.URL{Scheme: "ws", Host: hubListen},
+			Inference:    []agent.InferenceBackend{{Addr: url.URL{Scheme: "http", Host: inferenceListen}}},
+			WorkerName:   "test-worker",
+			ReconnectMin: 10 * time.Millisecond,
+			ReconnectMax: 50 * time.Millisecond,
+		}, ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// Start the hub and wait for the agent to connect
+	ctxHub, cancelHub := context.WithCancel(ctx)
+	wgHub := &sync.WaitGroup{}
+	wgHub.Add(1)
+	go func() {
+		defer wgHub.Done()
+		hub.RunServer(&hub.ServerOpts{Addr: hubListen}, ctxHub)
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	resp, err := http.Get(hubUrl.JoinPath("/internal/v1/workers").String())
+	assert.NoError(err)
+	var workers []hub.Worker
+	assert.NoError(json.NewDecoder(resp.Body).Decode(&workers))
+	assert.Len(workers, 1)
+
+	// Restart the hub, the agent should register again
+	cancelHub()
+	wgHub.Wait()
+	ctxHub, cancelHub = context.WithCancel(ctx)
+	defer cancelHub()
+	wgHub.Add(1)
+	go func() {
+		defer wgHub.Done()
+		hub.RunServer(&hub.ServerOpts{Addr: hubListen}, ctxHub)
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	resp, err = http.Get(hubUrl.JoinPath("/internal/v1/workers").String())
+	assert.NoError(err)
+	assert.NoError(json.NewDecoder(resp.Body).Decode(&workers))
+	assert.Len(workers, 1)
+
+	// Cancel the context and wait for everything to shut down
+	cancel()
+	wgHub.Wait()
+	wg.Wait()
+}
+
+func TestWorkerToken(t *testing.T) {
+	assert := assert.New(t)
+	wg := &sync.WaitGroup{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hubListen := "127.22.33.47:9090"
+	inferenceListen := "127.22.33.47:5000"
+	hubUrl := url.URL{Scheme: "http", Host: hubListen}
+
+	// Start the inference server
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		dummyInferenceServer(inferenceListen, ctx)
+	}()
+
+	// Start the server
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		hub.RunServer(&hub.ServerOpts{Addr: hubListen, WorkerTokens: []string{"secret"}}, ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	startAgent := func(token string, ctx context.Context) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			agent.RunAgent(&agent.AgentOpts{
+				HubAddr:    url.URL{Scheme: "ws", Host: hubListen},
+				HubToken:   token,
+				Inference:  []agent.InferenceBackend{{Addr: url.URL{Scheme: "http", Host: inferenceListen}}},
+				WorkerName: "test-worker",
+			}, ctx)
+		}()
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// Agent with the wrong token should be rejected
+	ctxAgent, cancelAgent := context.WithCancel(ctx)
+	startAgent("wrong", ctxAgent)
+	resp, err := http.Get(hubUrl.JoinPath("/internal/v1/workers").String())
+	assert.NoError(err)
+	var workers []hub.Worker
+	assert.NoError(json.NewDecoder(resp.Body).Decode(&workers))
+	assert.Len(workers, 0)
+	cancelAgent()
+
+	// Agent with the right token should be registered
+	startAgent("secret", ctx)
+	resp, err = http.Get(hubUrl.JoinPath("/internal/v1/workers").String())
+	assert.NoError(err)
+	assert.NoError(json.NewDecoder(resp.Body).Decode(&workers))
+	assert.Len(workers, 1)
+
+	// Cancel the context and wait for everything to shut down
+	cancel()
+	wg.Wait()
+}
+
+func TestApiKeys(t *testing.T) {
+	assert := assert.New(t)
+	wg := &sync.WaitGroup{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hubListen := "127.22.33.48:9090"
+	inferenceListen := "127.22.33.48:5000"
+	hubUrl := url.URL{Scheme: "http", Host: hubListen}
+
+	// Write the config file
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	assert.NoError(os.WriteFile(configFile, []byte(`{
+		"api_keys": [
+			{"key": "sk-all", "name": "all"},
+			{"key": "sk-other", "name": "other", "models": ["other-model"]},
+			{"key": "sk-limited", "name": "limited", "rate_limit": {"requests_per_minute": 1}}
+		]
+	}`), 0o600))
+
+	// Start the inference server
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		dummyInferenceServer(inferenceListen, ctx)
+	}()
+
+	// Start the server
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		hub.RunServer(&hub.ServerOpts{Addr: hubListen, ConfigFile: configFile}, ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// Start an agent
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		agent.RunAgent(&agent.AgentOpts{
+			HubAddr:    url.URL{Scheme: "ws", Host: hubListen},
+			Inference:  []agent.InferenceBackend{{Addr: url.URL{Scheme: "http", Host: inferenceListen}}},
+			WorkerName: "test-worker",
+		}, ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	doRequest := func(method string, path string, key string, body any) *http.Response {
+		var reader io.Reader
+		if body != nil {
+			enc, err := json.Marshal(body)
+			assert.NoError(err)
+			reader = bytes.NewReader(enc)
+		}
+		req, err := http.NewRequest(method, hubUrl.JoinPath(path).String(), reader)
+		assert.NoError(err)
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(err)
+		return resp
+	}
+
+	// Requests without a valid key should be rejected
+	var errResp message.ErrorResponse
+	resp := doRequest("GET", "/v1/models", "", nil)
+	assert.Equal(http.StatusUnauthorized, resp.StatusCode)
+	assert.NoError(json.NewDecoder(resp.Body).Decode(&errResp))
+	assert.NotEmpty(errResp.Error.Message)
+	resp = doRequest("GET", "/v1/models", "sk-wrong", nil)
+	assert.Equal(http.StatusUnauthorized, resp.StatusCode)
+
+	// The worker list would reveal every model, it needs the admin API
+	resp = doRequest("GET", "/internal/v1/workers", "sk-other", nil)
+	assert.Equal(http.StatusNotFound, resp.StatusCode)
+
+	// Models should be filtered per key
+	var models message.ListModelsResponse
+	resp = doRequest("GET", "/v1/models", "sk-all", nil)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.NoError(json.NewDecoder(resp.Body).Decode(&models))
+	assert.Len(models.Data, 1)
+	resp = doRequest("GET", "/v1/models", "sk-other", nil)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.NoError(json.NewDecoder(resp.Body).Decode(&models))
+	assert.Len(models.Data, 0)
+
+	// Completions should be restricted to the allowed models
+	req := message.CompletionsRequest{Model: "gpt-2", Prompt: "Hello,"}
+	resp = doRequest("POST", "/v1/completions", "sk-other", req)
+	assert.Equal(http.StatusForbidden, resp.StatusCode)
+	assert.NoError(json.NewDecoder(resp.Body).Decode(&errResp))
+	assert.Equal("model_not_allowed", *errResp.Error.Code)
+	resp = doRequest("POST", "/v1/completions", "sk-all", req)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	// Rate limited keys should get a 429 once over the limit
+	resp = doRequest("POST", "/v1/completions", "sk-limited", req)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	resp = doRequest("POST", "/v1/completions", "sk-limited", req)
+	assert.Equal(http.StatusTooManyRequests, resp.StatusCode)
+	assert.NotEmpty(resp.Header.Get("Retry-After"))
+	assert.NoError(json.NewDecoder(resp.Body).Decode(&errResp))
+	assert.Equal("rate_limit_exceeded", *errResp.Error.Code)
+
+	// Cancel the context and wait for everything to shut down
+	cancel()
+	wg.Wait()
+}
+
+func TestQueue(t *testing.T) {
+	assert := assert.New(t)
+	wg := &sync.WaitGroup{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hubListen := "127.22.33.49:9090"
+	inferenceListen := "127.22.33.49:5000"
+	busyListen := "127.22.33.49:5001"
+	hubUrl := url.URL{Scheme: "http", Host: hubListen}
+
+	// Start the inference server
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		dummyInferenceServer(inferenceListen, ctx)
+	}()
+
+	// Start the server
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		hub.RunServer(&hub.ServerOpts{Addr: hubListen, QueueSize: 1, QueueTimeout: 2 * time.Second}, ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// Send a request before any worker is available
+	req := message.CompletionsRequest{Model: "gpt-2", Prompt: "Hello,"}
+	enc, err := json.Marshal(req)
+	assert.NoError(err)
+	queued := make(chan *http.Response)
+	go func() {
+		resp, err := http.Post(hubUrl.JoinPath("/v1/completions").String(), "application/json", bytes.NewReader(enc))
+		assert.NoError(err)
+		queued <- resp
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// The queue only has room for one request
+	resp, err := http.Post(hubUrl.JoinPath("/v1/completions").String(), "application/json", bytes.NewReader(enc))
+	assert.NoError(err)
+	assert.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+
+	// Start an agent, the queued request should be served
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		agent.RunAgent(&agent.AgentOpts{
+			HubAddr:    url.URL{Scheme: "ws", Host: hubListen},
+			Inference:  []agent.InferenceBackend{{Addr: url.URL{Scheme: "http", Host: inferenceListen}}},
+			WorkerName: "test-worker",
+		}, ctx)
+	}()
+
+	select {
+	case resp = <-queued:
+		assert.Equal(http.StatusOK, resp.StatusCode)
+		var compResp message.CompletionsResponse
+		assert.NoError(json.NewDecoder(resp.Body).Decode(&compResp))
+		assert.Equal("Hello, world!", compResp.Choices[0].Text)
+	case <-time.After(time.Second):
+		assert.Fail("queued request was not served")
+	}
+
+	// Start an inference server whose streams are held until released
+	hold := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/models", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(message.ListModelsResponse{
+			Object: "list",
+			Data:   []message.Model{{Id: "gpt-3", Object: "model", OwnedBy: "openai"}},
+		})
+	})
+	mux.HandleFunc("/v1/completions", func(w http.ResponseWriter, r *http.Request) {
+		req := message.CompletionsRequest{}
+		json.NewDecoder(r.Body).Decode(&req)
+		chunk := message.CompletionsResponse{
+			ID:      "cmpl-0000",
+			Object:  "text_completion",
+			Model:   "gpt-3",
+			Choices: []message.CompletionsChoice{{Text: "Hello, world!"}},
+		}
+		if !req.Stream {
+			json.NewEncoder(w).Encode(chunk)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("data: "))
+		json.NewEncoder(w).Encode(chunk)
+		w.Write([]byte("\n"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-hold:
+		case <-r.Context().Done():
+		}
+	})
+	server := &http.Server{Addr: busyListen, Handler: mux}
+	go server.ListenAndServe()
+	defer server.Close()
+
+	// Start an agent that only takes one request at a time
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		agent.RunAgent(&agent.AgentOpts{
+			HubAddr:        url.URL{Scheme: "ws", Host: hubListen},
+			Inference:      []agent.InferenceBackend{{Addr: url.URL{Scheme: "http", Host: busyListen}}},
+			WorkerName:     "busy-worker",
+			MaxConcurrency: 1,
+		}, ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// Keep the worker busy with a stream
+	enc, err = json.Marshal(message.CompletionsRequest{Model: "gpt-3", Prompt: "Hello,", Stream: true})
+	assert.NoError(err)
+	stream, err := http.Post(hubUrl.JoinPath("/v1/completions").String(), "application/json", bytes.NewReader(enc))
+	assert.NoError(err)
+	defer stream.Body.Close()
+	reader := bufio.NewReader(stream.Body)
+	_, err = reader.ReadString('\n')
+	assert.NoError(err)
+
+	// Another request should wait for the worker to be free
+	enc, err = json.Marshal(message.CompletionsRequest{Model: "gpt-3", Prompt: "Hello,"})
+	assert.NoError(err)
+	go func() {
+		resp, err := http.Post(hubUrl.JoinPath("/v1/completions").String(), "application/json", bytes.NewReader(enc))
+		assert.NoError(err)
+		queued <- resp
+	}()
+	select {
+	case <-queued:
+		assert.Fail("request was served while the worker was busy")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// Once the stream completes, the waiting request should be served
+	close(hold)
+	_, err = io.ReadAll(reader)
+	assert.NoError(err)
+	select {
+	case resp = <-queued:
+		assert.Equal(http.StatusOK, resp.StatusCode)
+		var compResp message.CompletionsResponse
+		assert.NoError(json.NewDecoder(resp.Body).Decode(&compResp))
+		assert.Equal("Hello, world!", compResp.Choices[0].Text)
+	case <-time.After(time.Second):
+		assert.Fail("queued request was not served")
+	}
+
+	// Cancel the context and wait for everything to shut down
+	cancel()
+	wg.Wait()
+}
+
+func TestModelRefresh(t *testing.T) {
+	assert := assert.New(t)
+	wg := &sync.WaitGroup{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hubListen := "127.22.33.50:9090"
+	inferenceListen := "127.22.33.50:5000"
+	hubUrl := url.URL{Scheme: "http", Host: hubListen}
+
+	// Start an inference server whose models can be swapped out
+	models := []string{"gpt-2"}
+	modelsLock := sync.Mutex{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/models", func(w http.ResponseWriter, r *http.Request) {
+		modelsLock.Lock()
+		defer modelsLock.Unlock()
+
+		resp := message.ListModelsResponse{Object: "list", Data: []message.Model{}}
+		for _, id := range models {
+			resp.Data = append(resp.Data, message.Model{
+				Id:      id,
+				Object:  "model",
+				Created: int(time.Now().UnixMilli()),
+				OwnedBy: "openai",
+			})
+		}
+		json.NewEncoder(w).Encode(resp)
+	})
+	server := &http.Server{Addr: inferenceListen, Handler: mux}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		server.ListenAndServe()
+	}()
+
+	// Start the server
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		hub.RunServer(&hub.ServerOpts{Addr: hubListen}, ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// Start the agent
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		agent.RunAgent(&agent.AgentOpts{
+			HubAddr:         url.URL{Scheme: "ws", Host: hubListen},
+			Inference:       []agent.InferenceBackend{{Addr: url.URL{Scheme: "http", Host: inferenceListen}}},
+			WorkerName:      "test-worker",
+			RefreshInterval: 100 * time.Millisecond,
+		}, ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	listModels := func() []string {
+		resp, err := http.Get(hubUrl.JoinPath("/v1/models").String())
+		assert.NoError(err)
+		defer resp.Body.Close()
+
+		var list message.ListModelsResponse
+		assert.NoError(json.NewDecoder(resp.Body).Decode(&list))
+		ids := []string{}
+		for _, model := range list.Data {
+			ids = append(ids, model.Id)
+		}
+		return ids
+	}
+	assert.Equal([]string{"gpt-2"}, listModels())
+
+	// Load another model, the hub should pick it up without a reconnect
+	modelsLock.Lock()
+	models = []string{"gpt-2", "gpt-3"}
+	modelsLock.Unlock()
+	assert.Eventually(func() bool {
+		return len(listModels()) == 2
+	}, 2*time.Second, 50*time.Millisecond)
+
+	// Unload the first one
+	modelsLock.Lock()
+	models = []string{"gpt-3"}
+	modelsLock.Unlock()
+	assert.Eventually(func() bool {
+		ids := listModels()
+		return len(ids) == 1 && ids[0] == "gpt-3"
+	}, 2*time.Second, 50*time.Millisecond)
+
+	// The worker should still be the same one
+	resp, err := http.Get(hubUrl.JoinPath("/internal/v1/workers").String())
+	assert.NoError(err)
+	var workers []hub.Worker
+	assert.NoError(json.NewDecoder(resp.Body).Decode(&workers))
+	assert.Len(workers, 1)
+
+	// Cancel the context and wait for everything to shut down
+	cancel()
+	server.Shutdown(context.Background())
+	wg.Wait()
+}
+
+// stallingInferenceServer serves gpt-2 completions that never finish. For
+// streaming requests, one chunk is sent before stalling.
+func stallingInferenceServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/models", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(message.ListModelsResponse{
+			Object: "list",
+			Data:   []message.Model{{Id: "gpt-2", Object: "model", OwnedBy: "openai"}},
+		})
+	})
+	mux.HandleFunc("/v1/completions", func(w http.ResponseWriter, r *http.Request) {
+		req := message.CompletionsRequest{}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Stream {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("data: "))
+			json.NewEncoder(w).Encode(message.CompletionsResponse{
+				ID:      "cmpl-0000",
+				Object:  "text_completion",
+				Model:   "gpt-2",
+				Choices: []message.CompletionsChoice{{Text: "lmrouter"}},
+			})
+			w.Write([]byte("\n"))
+			w.(http.Flusher).Flush()
+		}
+		<-r.Context().Done()
+	})
+
+	server := &http.Server{Addr: addr, Handler: mux}
+	go server.ListenAndServe()
+	return server
+}
+
+// tcpProxy forwards connections to target until closed, which drops all of
+// them at once like a preempted machine would.
+type tcpProxy struct {
+	listener net.Listener
+	conns    []net.Conn
+	lock     sync.Mutex
+}
+
+func newTcpProxy(addr string, target string) (*tcpProxy, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &tcpProxy{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			upstream, err := net.Dial("tcp", target)
+			if err != nil {
+				conn.Close()
+				continue
+			}
+
+			p.lock.Lock()
+			p.conns = append(p.conns, conn, upstream)
+			p.lock.Unlock()
+			go io.Copy(upstream, conn)
+			go io.Copy(conn, upstream)
+		}
+	}()
+	return p, nil
+}
+
+func (p *tcpProxy) Close() {
+	p.listener.Close()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, conn := range p.conns {
+		conn.Close()
+	}
+}
+
+func TestFailover(t *testing.T) {
+	assert := assert.New(t)
+	wg := &sync.WaitGroup{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hubListen := "127.22.33.51:9090"
+	proxyListen := "127.22.33.51:9091"
+	stallingListen := "127.22.33.51:5000"
+	inferenceListen := "127.22.33.51:5001"
+	hubUrl := url.URL{Scheme: "http", Host: hubListen}
+
+	// Start the inference servers
+	stalling := stallingInferenceServer(stallingListen)
+	defer stalling.Close()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		dummyInferenceServer(inferenceListen, ctx)
+	}()
+
+	// Start the server
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		hub.RunServer(&hub.ServerOpts{Addr: hubListen}, ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// Start an agent for the stalling server, connected through a proxy
+	proxy, err := newTcpProxy(proxyListen, hubListen)
+	assert.NoError(err)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		agent.RunAgent(&agent.AgentOpts{
+			HubAddr:    url.URL{Scheme: "ws", Host: proxyListen},
+			Inference:  []agent.InferenceBackend{{Addr: url.URL{Scheme: "http", Host: stallingListen}}},
+			WorkerName: "doomed-worker",
+		}, ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// Start a stream, which gets its first chunk and then stalls
+	req := message.CompletionsRequest{Model: "gpt-2", Prompt: "Hello,", Stream: true}
+	enc, err := json.Marshal(req)
+	assert.NoError(err)
+	streamResp, err := http.Post(hubUrl.JoinPath("/v1/completions").String(), "application/json", bytes.NewReader(enc))
+	assert.NoError(err)
+	defer streamResp.Body.Close()
+	reader := bufio.NewReader(streamResp.Body)
+	line, err := reader.ReadString('\n')
+	assert.NoError(err)
+	assert.Contains(line, "lmrouter")
+
+	// Start a non-streaming request, which stalls without any output
+	req.Stream = false
+	enc, err = json.Marshal(req)
+	assert.NoError(err)
+	done := make(chan *http.Response)
+	go func() {
+		resp, err := http.Post(hubUrl.JoinPath("/v1/completions").String(), "application/json", bytes.NewReader(enc))
+		assert.NoError(err)
+		done <- resp
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// Bring up a healthy worker, then drop the stalling one
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		agent.RunAgent(&agent.AgentOpts{
+			HubAddr:    url.URL{Scheme: "ws", Host: hubListen},
+			Inference:  []agent.InferenceBackend{{Addr: url.URL{Scheme: "http", Host: inferenceListen}}},
+			WorkerName: "healthy-worker",
+		}, ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	proxy.Close()
+
+	// The non-streaming request should be retried on the healthy worker
+	select {
+	case resp := <-done:
+		assert.Equal(http.StatusOK, resp.StatusCode)
+		var compResp message.CompletionsResponse
+		assert.NoError(json.NewDecoder(resp.Body).Decode(&compResp))
+		assert.Equal("Hello, world!", compResp.Choices[0].Text)
+	case <-time.After(2 * time.Second):
+		assert.Fail("request was not retried")
+	}
+
+	// The stream should end with an error finish reason and an error event
+	rest, err := io.ReadAll(reader)
+	assert.NoError(err)
+	assert.Contains(string(rest), `"finish_reason":"error"`)
+	assert.Contains(string(rest), "event: error\ndata: ")
+	assert.Contains(string(rest), "worker_disconnected")
+
+	// Cancel the context and wait for everything to shut down
+	cancel()
+	wg.Wait()
+}
+
+func TestAgentDrain(t *testing.T) {
+	assert := assert.New(t)
+	wg := &sync.WaitGroup{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hubListen := "127.22.33.52:9090"
+	inferenceListen := "127.22.33.52:5000"
+	hubUrl := url.URL{Scheme: "http", Host: hubListen}
+
+	// Start the inference server
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		dummyInferenceServer(inferenceListen, ctx)
+	}()
+
+	// Start the server
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		hub.RunServer(&hub.ServerOpts{Addr: hubListen}, ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// Start the agent
+	agentDone := make(chan struct{})
+	go func() {
+		defer close(agentDone)
+		agent.RunAgent(&agent.AgentOpts{
+			HubAddr:      url.URL{Scheme: "ws", Host: hubListen},
+			Inference:    []agent.InferenceBackend{{Addr: url.URL{Scheme: "http", Host: inferenceListen}}},
+			WorkerName:   "test-worker",
+			DrainTimeout: 5 * time.Second,
+		}, ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// Start a stream, then ask the agent to drain
+	req := message.CompletionsRequest{Model: "gpt-2", Prompt: "Hello,", Stream: true}
+	enc, err := json.Marshal(req)
+	assert.NoError(err)
+	resp, err := http.Post(hubUrl.JoinPath("/v1/completions").String(), "application/json", bytes.NewReader(enc))
+	assert.NoError(err)
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+	_, err = reader.ReadString('\n')
+	assert.NoError(err)
+	assert.NoError(syscall.Kill(os.Getpid(), syscall.SIGTERM))
+	time.Sleep(10 * time.Millisecond)
+
+	// New requests should no longer be routed to the agent
+	req.Stream = false
+	enc, err = json.Marshal(req)
+	assert.NoError(err)
+	rejected, err := http.Post(hubUrl.JoinPath("/v1/completions").String(), "application/json", bytes.NewReader(enc))
+	assert.NoError(err)
+	assert.Equal(http.StatusServiceUnavailable, rejected.StatusCode)
+
+	// The stream in progress should complete normally
+	rest, err := io.ReadAll(reader)
+	assert.NoError(err)
+	assert.Equal(5, strings.Count(string(rest), "data: "))
+	assert.NotContains(string(rest), "event: error")
+
+	// The agent should exit instead of reconnecting
+	select {
+	case <-agentDone:
+	case <-time.After(2 * time.Second):
+		assert.Fail("agent did not exit after draining")
+	}
+	workersResp, err := http.Get(hubUrl.JoinPath("/internal/v1/workers").String())
+	assert.NoError(err)
+	var workers []hub.Worker
+	assert.NoError(json.NewDecoder(workersResp.Body).Decode(&workers))
+	assert.Len(workers, 0)
+
+	// Cancel the context and wait for everything to shut down
+	cancel()
+	wg.Wait()
+}
+
+func TestHubShutdown(t *testing.T) {
+	assert := assert.New(t)
+	wg := &sync.WaitGroup{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hubListen := "127.22.33.53:9090"
+	inferenceListen := "127.22.33.53:5000"
+	hubUrl := url.URL{Scheme: "http", Host: hubListen}
+
+	// Start the inference server
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		dummyInferenceServer(inferenceListen, ctx)
+	}()
+
+	// Start the server with its own context
+	hubCtx, hubCancel := context.WithCancel(ctx)
+	hubDone := make(chan struct{})
+	go func() {
+		defer close(hubDone)
+		hub.RunServer(&hub.ServerOpts{Addr: hubListen, ShutdownTimeout: 5 * time.Second}, hubCtx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// Start the agent
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		agent.RunAgent(&agent.AgentOpts{
+			HubAddr:      url.URL{Scheme: "ws", Host: hubListen},
+			Inference:    []agent.InferenceBackend{{Addr: url.URL{Scheme: "http", Host: inferenceListen}}},
+			WorkerName:   "test-worker",
+			ReconnectMin: 100 * time.Millisecond,
+			ReconnectMax: 100 * time.Millisecond,
+		}, ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// Start a stream, then shut the hub down
+	req := message.CompletionsRequest{Model: "gpt-2", Prompt: "Hello,", Stream: true}
+	enc, err := json.Marshal(req)
+	assert.NoError(err)
+	resp, err := http.Post(hubUrl.JoinPath("/v1/completions").String(), "application/json", bytes.NewReader(enc))
+	assert.NoError(err)
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+	_, err = reader.ReadString('\n')
+	assert.NoError(err)
+	hubCancel()
+	time.Sleep(10 * time.Millisecond)
+
+	// New requests should be turned away
+	rejected, err := http.Post(hubUrl.JoinPath("/v1/completions").String(), "application/json", bytes.NewReader(enc))
+	assert.NoError(err)
+	assert.Equal(http.StatusServiceUnavailable, rejected.StatusCode)
+
+	// Anthropic clients should get an Anthropic error
+	rejected, err = http.Post(hubUrl.JoinPath("/v1/messages").String(), "application/json",
+		strings.NewReader(`{"model":"gpt-2","max_tokens":16,"messages":[{"role":"user","content":"Hi"}]}`))
+	assert.NoError(err)
+	assert.Equal(http.StatusServiceUnavailable, rejected.StatusCode)
+	var anthropicErr message.AnthropicErrorResponse
+	assert.NoError(json.NewDecoder(rejected.Body).Decode(&anthropicErr))
+	assert.Equal("error", anthropicErr.Type)
+	assert.Equal("overloaded_error", anthropicErr.Error.Type)
+
+	// So should Ollama clients
+	rejected, err = http.Post(hubUrl.JoinPath("/api/chat").String(), "application/json",
+		strings.NewReader(`{"model":"gpt-2","messages":[{"role":"user","content":"Hi"}]}`))
+	assert.NoError(err)
+	assert.Equal(http.StatusServiceUnavailable, rejected.StatusCode)
+	var ollamaErr message.OllamaErrorResponse
+	assert.NoError(json.NewDecoder(rejected.Body).Decode(&ollamaErr))
+	assert.Contains(ollamaErr.Error, "shutting down")
+
+	// The stream in progress should complete normally
+	rest, err := io.ReadAll(reader)
+	assert.NoError(err)
+	assert.Equal(5, strings.Count(string(rest), "data: "))
+	assert.NotContains(string(rest), "event: error")
+	<-hubDone
+
+	// The agent should reconnect once the hub is back
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		hub.RunServer(&hub.ServerOpts{Addr: hubListen}, ctx)
+	}()
+	assert.Eventually(func() bool {
+		resp, err := http.Get(hubUrl.JoinPath("/internal/v1/workers").String())
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+
+		var workers []hub.Worker
+		json.NewDecoder(resp.Body).Decode(&workers)
+		return len(workers) == 1
+	}, 2*time.Second, 50*time.Millisecond)
+
+	// Cancel the context and wait for everything to shut down
+	cancel()
+	wg.Wait()
+}
+
+func TestAdminApi(t *testing.T) {
+	assert := assert.New(t)
+	wg := &sync.WaitGroup{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hubListen := "127.22.33.54:9090"
+	inferenceListen := "127.22.33.54:5000"
+	hubUrl := url.URL{Scheme: "http", Host: hubListen}
+
+	// Start the inference server
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		dummyInferenceServer(inferenceListen, ctx)
+	}()
+
+	// Start the server
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		hub.RunServer(&hub.ServerOpts{Addr: hubListen, AdminTokens: []string{"admin-secret"}}, ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// Start the agent
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		agent.RunAgent(&agent.AgentOpts{
+			HubAddr:      url.URL{Scheme: "ws", Host: hubListen},
+			Inference:    []agent.InferenceBackend{{Addr: url.URL{Scheme: "http", Host: inferenceListen}}},
+			WorkerName:   "test-worker",
+			ReconnectMin: 100 * time.Millisecond,
+			ReconnectMax: 200 * time.Millisecond,
+		}, ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	type workerStatus struct {
+		Id            string    `json:"id"`
+		Name          string    `json:"name"`
+		Draining      bool      `json:"draining"`
+		Weight        float64   `json:"weight"`
+		TotalRequests int       `json:"total_requests"`
+		ConnectedAt   time.Time `json:"connected_at"`
+	}
+	doAdmin := func(method string, path string, token string, body string) *http.Response {
+		req, err := http.NewRequest(method, hubUrl.JoinPath(path).String(), strings.NewReader(body))
+		assert.NoError(err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(err)
+		return resp
+	}
+	listWorkers := func() []workerStatus {
+		resp := doAdmin("GET", "/admin/v1/workers", "admin-secret", "")
+		defer resp.Body.Close()
+		var workers []workerStatus
+		assert.NoError(json.NewDecoder(resp.Body).Decode(&workers))
+		return workers
+	}
+	complete := func() int {
+		enc, err := json.Marshal(message.CompletionsRequest{Model: "gpt-2", Prompt: "Hello,"})
+		assert.NoError(err)
+		resp, err := http.Post(hubUrl.JoinPath("/v1/completions").String(), "application/json", bytes.NewReader(enc))
+		assert.NoError(err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// The admin API requires the admin token
+	resp := doAdmin("GET", "/admin/v1/workers", "", "")
+	assert.Equal(http.StatusUnauthorized, resp.StatusCode)
+	resp = doAdmin("GET", "/admin/v1/workers", "wrong", "")
+	assert.Equal(http.StatusUnauthorized, resp.StatusCode)
+	resp = doAdmin("GET", "/internal/v1/workers", "", "")
+	assert.Equal(http.StatusUnauthorized, resp.StatusCode)
+	resp = doAdmin("GET", "/internal/v1/workers", "admin-secret", "")
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	var internalWorkers []hub.Worker
+	assert.NoError(json.NewDecoder(resp.Body).Decode(&internalWorkers))
+	assert.Len(internalWorkers, 1)
+
+	// List the workers
+	workers := listWorkers()
+	assert.Len(workers, 1)
+	assert.Equal("test-worker", workers[0].Name)
+	assert.False(workers[0].ConnectedAt.IsZero())
+	assert.Equal(float64(1), workers[0].Weight)
+	firstId := workers[0].Id
+
+	// Requests are counted
+	assert.Equal(http.StatusOK, complete())
+	assert.Equal(1, listWorkers()[0].TotalRequests)
+
+	// Unknown workers
+	resp = doAdmin("POST", "/admin/v1/workers/nobody/drain", "admin-secret", "")
+	assert.Equal(http.StatusNotFound, resp.StatusCode)
+
+	// Drain and undrain the worker by name
+	resp = doAdmin("POST", "/admin/v1/workers/test-worker/drain", "admin-secret", "")
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.True(listWorkers()[0].Draining)
+	assert.Equal(http.StatusServiceUnavailable, complete())
+	resp = doAdmin("POST", "/admin/v1/workers/test-worker/undrain", "admin-secret", "")
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal(http.StatusOK, complete())
+
+	// Set the weight by id
+	resp = doAdmin("PUT", "/admin/v1/workers/"+firstId+"/weight", "admin-secret", `{"weight": 2.5}`)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal(2.5, listWorkers()[0].Weight)
+	resp = doAdmin("PUT", "/admin/v1/workers/"+firstId+"/weight", "admin-secret", `{"weight": -1}`)
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+
+	// Disconnect the worker, it should come back with a new id
+	resp = doAdmin("POST", "/admin/v1/workers/"+firstId+"/disconnect", "admin-secret", "")
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Eventually(func() bool {
+		workers := listWorkers()
+		return len(workers) == 1 && workers[0].Id != firstId
+	}, 2*time.Second, 50*time.Millisecond)
+
+	// Ban the worker, it should not be able to come back
+	resp = doAdmin("POST", "/admin/v1/workers/test-worker/ban", "admin-secret", "")
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	time.Sleep(500 * time.Millisecond)
+	assert.Len(listWorkers(), 0)
+
+	resp = doAdmin("GET", "/admin/v1/bans", "admin-secret", "")
+	var bans []string
+	assert.NoError(json.NewDecoder(resp.Body).Decode(&bans))
+	assert.Equal([]string{"test-worker"}, bans)
+
+	// Lift the ban, the worker should come back
+	resp = doAdmin("DELETE", "/admin/v1/bans/test-worker", "admin-secret", "")
+	assert.Equal(http.StatusNoContent, resp.StatusCode)
+	assert.Eventually(func() bool {
+		return len(listWorkers()) == 1
+	}, 2*time.Second, 50*time.Millisecond)
+
+	// Cancel the context and wait for everything to shut down
+	cancel()
+	wg.Wait()
+}
+
+func TestModelAliases(t *testing.T) {
+	assert := assert.New(t)
+	wg := &sync.WaitGroup{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hubListen := "127.22.33.55:9090"
+	inferenceListen := "127.22.33.55:5000"
+	hubUrl := url.URL{Scheme: "http", Host: hubListen}
+
+	// Write the config file
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	assert.NoError(os.WriteFile(configFile, []byte(`{
+		"aliases": [
+			{"alias": "gpt-3.5-turbo", "models": ["llama-*", "gpt-*"]},
+			{"alias": "by-regex", "models": ["/^gpt-\\d$/"]},
+			{"alias": "unavailable", "models": ["llama-*"]}
+		]
+	}`), 0o600))
+
+	// Start the inference server
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		dummyInferenceServer(inferenceListen, ctx)
+	}()
+
+	// Start the server
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		hub.RunServer(&hub.ServerOpts{Addr: hubListen, ConfigFile: configFile}, ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// Start an agent
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		agent.RunAgent(&agent.AgentOpts{
+			HubAddr:    url.URL{Scheme: "ws", Host: hubListen},
+			Inference:  []agent.InferenceBackend{{Addr: url.URL{Scheme: "http", Host: inferenceListen}}},
+			WorkerName: "test-worker",
+		}, ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// Aliases that resolve to a served model should be listed
+	resp, err := http.Get(hubUrl.JoinPath("/v1/models").String())
+	assert.NoError(err)
+	var models message.ListModelsResponse
+	assert.NoError(json.NewDecoder(resp.Body).Decode(&models))
+	ids := []string{}
+	for _, model := range models.Data {
+		ids = append(ids, model.Id)
+	}
+	assert.ElementsMatch([]string{"gpt-2", "gpt-3.5-turbo", "by-regex"}, ids)
+
+	complete := func(model string, stream bool) *http.Response {
+		enc, err := json.Marshal(message.CompletionsRequest{Model: model, Prompt: "Hello,", Stream: stream})
+		assert.NoError(err)
+		resp, err := http.Post(hubUrl.JoinPath("/v1/completions").String(), "application/json", bytes.NewReader(enc))
+		assert.NoError(err)
+		return resp
+	}
+
+	// Requests for an alias are served by the real model, under the alias
+	for _, alias := range []string{"gpt-3.5-turbo", "by-regex"} {
+		resp = complete(alias, false)
+		assert.Equal(http.StatusOK, resp.StatusCode)
+		var compResp message.CompletionsResponse
+		assert.NoError(json.NewDecoder(resp.Body).Decode(&compResp))
+		assert.Equal("Hello, world!", compResp.Choices[0].Text)
+		assert.Equal(alias, compResp.Model)
+	}
+
+	// Streamed chunks are rewritten too
+	resp = complete("gpt-3.5-turbo", true)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	scanner := bufio.NewScanner(resp.Body)
+	chunks := 0
+	for scanner.Scan() {
+		line, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var compResp message.CompletionsResponse
+		assert.NoError(json.Unmarshal([]byte(line), &compResp))
+		assert.Equal("gpt-3.5-turbo", compResp.Model)
+		chunks++
+	}
+	assert.Equal(6, chunks)
+
+	// Aliases without a matching model are not served
+	resp = complete("unavailable", false)
+	assert.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+
+	// Cancel the context and wait for everything to shut down
+	cancel()
+	wg.Wait()
+}
+
+func TestModelFallback(t *testing.T) {
+	assert := assert.New(t)
+	wg := &sync.WaitGroup{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hubListen := "127.22.33.56:9090"
+	inferenceListen := "127.22.33.56:5000"
+	hubUrl := url.URL{Scheme: "http", Host: hubListen}
+
+	// Write the config file
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	assert.NoError(os.WriteFile(configFile, []byte(`{
+		"fallbacks": {
+			"gpt-4": ["gpt-3", "gpt-2"]
+		},
+		"api_keys": [
+			{"key": "sk-all", "name": "all"},
+			{"key": "sk-gpt4", "name": "gpt4", "models": ["gpt-4", "gpt-3"]}
+		]
+	}`), 0o600))
+
+	// Start the inference server
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		dummyInferenceServer(inferenceListen, ctx)
+	}()
+
+	// Start the server
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		hub.RunServer(&hub.ServerOpts{
+			Addr:          hubListen,
+			ConfigFile:    configFile,
+			QueueSize:     4,
+			QueueTimeout:  2 * time.Second,
+			FallbackAfter: 200 * time.Millisecond,
+		}, ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// Start an agent
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		agent.RunAgent(&agent.AgentOpts{
+			HubAddr:    url.URL{Scheme: "ws", Host: hubListen},
+			Inference:  []agent.InferenceBackend{{Addr: url.URL{Scheme: "http", Host: inferenceListen}}},
+			WorkerName: "test-worker",
+		}, ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	completeWithKey := func(model string, key string) *http.Response {
+		enc, err := json.Marshal(message.CompletionsRequest{Model: model, Prompt: "Hello,"})
+		assert.NoError(err)
+		req, err := http.NewRequest("POST", hubUrl.JoinPath("/v1/completions").String(), bytes.NewReader(enc))
+		assert.NoError(err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+key)
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(err)
+		return resp
+	}
+	complete := func(model string) *http.Response {
+		return completeWithKey(model, "sk-all")
+	}
+
+	// The primary model is served directly
+	resp := complete("gpt-2")
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal("gpt-2", resp.Header.Get("X-Served-Model"))
+
+	// Neither gpt-4 nor gpt-3 are available, each is waited for before
+	// falling back to the next one
+	start := time.Now()
+	resp = complete("gpt-4")
+	elapsed := time.Since(start)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal("gpt-2", resp.Header.Get("X-Served-Model"))
+	var compResp message.CompletionsResponse
+	assert.NoError(json.NewDecoder(resp.Body).Decode(&compResp))
+	assert.Equal("Hello, world!", compResp.Choices[0].Text)
+	assert.Equal("gpt-2", compResp.Model)
+	assert.GreaterOrEqual(elapsed, 400*time.Millisecond)
+	assert.Less(elapsed, time.Second)
+
+	// Models without fallbacks still wait for the full queue timeout
+	start = time.Now()
+	resp = complete("gpt-3")
+	assert.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+	assert.GreaterOrEqual(time.Since(start), 2*time.Second)
+
+	// Keys restricted from a fallback model are not served by it, gpt-3 is
+	// their last option and is waited for up to the queue timeout
+	start = time.Now()
+	resp = completeWithKey("gpt-4", "sk-gpt4")
+	assert.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Empty(resp.Header.Get("X-Served-Model"))
+	assert.GreaterOrEqual(time.Since(start), 2*time.Second)
+
+	// Cancel the context and wait for everything to shut down
+	cancel()
+	wg.Wait()
+}
+
+func TestRoutingPolicies(t *testing.T) {
+	assert := assert.New(t)
+
+	// Unknown policies are rejected
+	err := hub.RunServer(&hub.ServerOpts{Addr: "127.22.33.57:9090", Routing: "fastest"}, context.Background())
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "unknown routing policy")
+	}
+
+	for i, policy := range []string{"round-robin", "latency"} {
+		wg := &sync.WaitGroup{}
+		ctx, cancel := context.WithCancel(context.Background())
+
+		hubListen := fmt.Sprintf("127.22.33.%d:9090", 57+i)
+		inferenceListen := fmt.Sprintf("127.22.33.%d:5000", 57+i)
+		slowListen := fmt.Sprintf("127.22.33.%d:5001", 57+i)
+		hubUrl := url.URL{Scheme: "http", Host: hubListen}
+
+		// Start the inference server, and a slower view of it
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dummyInferenceServer(inferenceListen, ctx)
+		}()
+		slow := &http.Server{
+			Addr: slowListen,
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/v1/completions" {
+					time.Sleep(300 * time.Millisecond)
+				}
+				httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: inferenceListen}).ServeHTTP(w, r)
+			}),
+		}
+		go slow.ListenAndServe()
+
+		// Start the server
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			hub.RunServer(&hub.ServerOpts{Addr: hubListen, Routing: policy, AdminTokens: []string{"admin"}}, ctx)
+		}()
+		time.Sleep(100 * time.Millisecond)
+
+		// Start a fast and a slow agent
+		for name, addr := range map[string]string{"fast": inferenceListen, "slow": slowListen} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				agent.RunAgent(&agent.AgentOpts{
+					HubAddr:    url.URL{Scheme: "ws", Host: hubListen},
+					Inference:  []agent.InferenceBackend{{Addr: url.URL{Scheme: "http", Host: addr}}},
+					WorkerName: name,
+				}, ctx)
+			}()
+		}
+		time.Sleep(200 * time.Millisecond)
+
+		// Send requests one after the other
+		for range 10 {
+			enc, err := json.Marshal(message.CompletionsRequest{Model: "gpt-2", Prompt: "Hello,", Stream: true})
+			assert.NoError(err)
+			resp, err := http.Post(hubUrl.JoinPath("/v1/completions").String(), "application/json", bytes.NewReader(enc))
+			assert.NoError(err)
+			io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+
+		// Count the requests served by each worker
+		req, err := http.NewRequest("GET", hubUrl.JoinPath("/admin/v1/workers").String(), nil)
+		assert.NoError(err)
+		req.Header.Set("Authorization", "Bearer admin")
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(err)
+		var workers []struct {
+			Name          string `json:"name"`
+			TotalRequests int    `json:"total_requests"`
+		}
+		assert.NoError(json.NewDecoder(resp.Body).Decode(&workers))
+		served := map[string]int{}
+		for _, worker := range workers {
+			served[worker.Name] = worker.TotalRequests
+		}
+
+		switch policy {
+		case "round-robin":
+			assert.Equal(map[string]int{"fast": 5, "slow": 5}, served)
+		case "latency":
+			// The slow worker is only tried until its latency is known
+			assert.Equal(10, served["fast"]+served["slow"])
+			assert.LessOrEqual(served["slow"], 2)
+		}
+
+		// Cancel the context and wait for everything to shut down
+		cancel()
+		slow.Close()
+		wg.Wait()
+	}
+}
+
+func TestPrefixAffinity(t *testing.T) {
+	assert := assert.New(t)
+	wg := &sync.WaitGroup{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hubListen := "127.22.33.59:9090"
+	inferenceListen := "127.22.33.59:5000"
+	hubUrl := url.URL{Scheme: "http", Host: hubListen}
+
+	// Start the inference server
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		dummyInferenceServer(inferenceListen, ctx)
+	}()
+
+	// Start the server, round robin would alternate between workers
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		hub.RunServer(&hub.ServerOpts{
+			Addr:           hubListen,
+			Routing:        "round-robin",
+			AffinityPrefix: 16,
+			AffinityHeader: "X-Session-Id",
+			AdminTokens:    []string{"admin"},
+		}, ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// Start two agents
+	for _, name := range []string{"worker-a", "worker-b"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			agent.RunAgent(&agent.AgentOpts{
+				HubAddr:    url.URL{Scheme: "ws", Host: hubListen},
+				Inference:  []agent.InferenceBackend{{Addr: url.URL{Scheme: "http", Host: inferenceListen}}},
+				WorkerName: name,
+			}, ctx)
+		}()
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	served := func() map[string]int {
+		req, err := http.NewRequest("GET", hubUrl.JoinPath("/admin/v1/workers").String(), nil)
+		assert.NoError(err)
+		req.Header.Set("Authorization", "Bearer admin")
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(err)
+		defer resp.Body.Close()
+
+		var workers []struct {
+			Name          string `json:"name"`
+			TotalRequests int    `json:"total_requests"`
+		}
+		assert.NoError(json.NewDecoder(resp.Body).Decode(&workers))
+		counts := map[string]int{}
+		for _, worker := range workers {
+			counts[worker.Name] = worker.TotalRequests
+		}
+		return counts
+	}
+	complete := func(prompt string, session string) {
+		enc, err := json.Marshal(message.CompletionsRequest{Model: "gpt-2", Prompt: prompt})
+		assert.NoError(err)
+		req, err := http.NewRequest("POST", hubUrl.JoinPath("/v1/completions").String(), bytes.NewReader(enc))
+		assert.NoError(err)
+		if session != "" {
+			req.Header.Set("X-Session-Id", session)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(err)
+		assert.Equal(http.StatusOK, resp.StatusCode)
+		resp.Body.Close()
+	}
+	onOneWorker := func(before map[string]int, n int) {
+		after := served()
+		a := after["worker-a"] - before["worker-a"]
+		b := after["worker-b"] - before["worker-b"]
+		assert.True((a == n && b == 0) || (a == 0 && b == n), "requests split %d/%d", a, b)
+	}
+
+	// Prompts sharing a prefix stick to one worker
+	before := served()
+	for i := range 6 {
+		complete(fmt.Sprintf("You are a helpful assistant. Turn %d", i), "")
+	}
+	onOneWorker(before, 6)
+
+	// So do requests of the same session
+	before = served()
+	for i := range 6 {
+		complete(fmt.Sprintf("Prompt %d", i), "session-1")
+	}
+	onOneWorker(before, 6)
+
+	// Start a hub with session affinity but no prefix hashing, along with two
+	// agents for it
+	hubListen = "127.22.33.59:9091"
+	hubUrl = url.URL{Scheme: "http", Host: hubListen}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		hub.RunServer(&hub.ServerOpts{
+			Addr:           hubListen,
+			Routing:        "round-robin",
+			AffinityHeader: "X-Session-Id",
+			AdminTokens:    []string{"admin"},
+		}, ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	for _, name := range []string{"worker-a", "worker-b"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			agent.RunAgent(&agent.AgentOpts{
+				HubAddr:    url.URL{Scheme: "ws", Host: hubListen},
+				Inference:  []agent.InferenceBackend{{Addr: url.URL{Scheme: "http", Host: inferenceListen}}},
+				WorkerName: name,
+			}, ctx)
+		}()
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	// Requests of the same session still stick to one worker
+	before = served()
+	for i := range 6 {
+		complete(fmt.Sprintf("Prompt %d", i), "session-1")
+	}
+	onOneWorker(before, 6)
+
+	// Prompts sharing a prefix do not
+	before = served()
+	for i := range 6 {
+		complete(fmt.Sprintf("You are a helpful assistant. Turn %d", i), "")
+	}
+	after := served()
+	assert.Equal(3, after["worker-a"]-before["worker-a"])
+	assert.Equal(3, after["worker-b"]-before["worker-b"])
+
+	// Start an inference server that does not advertise its slots, whose
+	// streams are held until released
+	heldListen := "127.22.33.59:5001"
+	hold := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/models", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(message.ListModelsResponse{
+			Object: "list",
+			Data:   []message.Model{{Id: "gpt-3", Object: "model", OwnedBy: "openai"}},
+		})
+	})
+	mux.HandleFunc("/v1/completions", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("data: "))
+		json.NewEncoder(w).Encode(message.CompletionsResponse{
+			ID:      "cmpl-0000",
+			Object:  "text_completion",
+			Model:   "gpt-3",
+			Choices: []message.CompletionsChoice{{Text: "lmrouter"}},
+		})
+		w.Write([]byte("\n"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-hold:
+		case <-r.Context().Done():
+		}
+	})
+	server := &http.Server{Addr: heldListen, Handler: mux}
+	go server.ListenAndServe()
+	defer server.Close()
+
+	// Start two slot-less agents for it
+	for _, name := range []string{"slotless-a", "slotless-b"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			agent.RunAgent(&agent.AgentOpts{
+				HubAddr:    url.URL{Scheme: "ws", Host: hubListen},
+				Inference:  []agent.InferenceBackend{{Addr: url.URL{Scheme: "http", Host: heldListen}}},
+				WorkerName: name,
+			}, ctx)
+		}()
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	// A slot-less worker never runs out of capacity, but once it is busy the
+	// session spills over to an idle worker rather than piling up on it
+	enc, err := json.Marshal(message.CompletionsRequest{Model: "gpt-3", Prompt: "Hello,", Stream: true})
+	assert.NoError(err)
+	for range 2 {
+		req, err := http.NewRequest("POST", hubUrl.JoinPath("/v1/completions").String(), bytes.NewReader(enc))
+		assert.NoError(err)
+		req.Header.Set("X-Session-Id", "session-2")
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(err)
+		assert.Equal(http.StatusOK, resp.StatusCode)
+		_, err = bufio.NewReader(resp.Body).ReadString('\n')
+		assert.NoError(err)
+		defer resp.Body.Close()
+	}
+	workers, err := adminWorkers(hubUrl, "admin")
+	assert.NoError(err)
+	assert.Equal(1, workers["slotless-a"].ActiveTasks)
+	assert.Equal(1, workers["slotless-b"].ActiveTasks)
+	close(hold)
+
+	// Cancel the context and wait for everything to shut down
+	cancel()
+	wg.Wait()
+}
+
+// embeddingsInferenceServer serves a single embedding model.
+func embeddingsInferenceServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/models", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(message.ListModelsResponse{
+			Object: "list",
+			Data:   []message.Model{{Id: "text-embedding-small", Object: "model", OwnedBy: "openai"}},
+		})
+	})
+	mux.HandleFunc("/v1/embeddings", func(w http.ResponseWriter, r *http.Request) {
+		req := message.EmbeddingsRequest{}
+		json.NewDecoder(r.Body).Decode(&req)
+		json.NewEncoder(w).Encode(message.EmbeddingsResponse{
+			Object: "list",
+			Data: []message.Embedding{
+				{Object: "embedding", Index: 0, Embedding: []float32{0.1, 0.2, 0.3}},
+			},
+			Model: req.Model,
+			Usage: &message.EmbeddingsUsage{PromptTokens: 2, TotalTokens: 2},
+		})
+	})
+
+	server := &http.Server{Addr: addr, Handler: mux}
+	go server.ListenAndServe()
+	return server
+}
+
+func TestEmbeddings(t *testing.T) {
+	assert := assert.New(t)
+	wg := &sync.WaitGroup{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hubListen := "127.22.33.60:9090"
+	inferenceListen := "127.22.33.60:5000"
+	embeddingsListen := "127.22.33.60:5001"
+	hubUrl := url.URL{Scheme: "http", Host: hubListen}
+
+	// Start the inference servers
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		dummyInferenceServer(inferenceListen, ctx)
+	}()
+	server := embeddingsInferenceServer(embeddingsListen)
+	defer server.Close()
+
+	// Start the server
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		hub.RunServer(&hub.ServerOpts{Addr: hubListen}, ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// Start an agent for each inference server
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		agent.RunAgent(&agent.AgentOpts{
+			HubAddr:    url.URL{Scheme: "ws", Host: hubListen},
+			Inference:  []agent.InferenceBackend{{Addr: url.URL{Scheme: "http", Host: inferenceListen}}},
+			WorkerName: "completions-worker",
+		}, ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		agent.RunAgent(&agent.AgentOpts{
+			HubAddr:         url.URL{Scheme: "ws", Host: hubListen},
+			Inference:       []agent.InferenceBackend{{Addr: url.URL{Scheme: "http", Host: embeddingsListen}}},
+			WorkerName:      "embeddings-worker",
+			EmbeddingModels: []string{"text-embedding-small"},
+		}, ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// The embedding model should be listed as such
+	resp, err := http.Get(hubUrl.JoinPath("/v1/models").String())
+	assert.NoError(err)
+	var models message.ListModelsResponse
+	assert.NoError(json.NewDecoder(resp.Body).Decode(&models))
+	embeddingsOnly := map[string]bool{}
+	for _, model := range models.Data {
+		embeddingsOnly[model.Id] = model.EmbeddingsOnly
+	}
+	assert.Equal(map[string]bool{"gpt-2": false, "text-embedding-small": true}, embeddingsOnly)
+
+	// Embeddings requests are proxied to the worker serving the model
+	enc, err := json.Marshal(message.EmbeddingsRequest{Model: "text-embedding-small", Input: "Hello, world!"})
+	assert.NoError(err)
+	resp, err = http.Post(hubUrl.JoinPath("/v1/embeddings").String(), "application/json", bytes.NewReader(enc))
+	assert.NoError(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	var embResp message.EmbeddingsResponse
+	assert.NoError(json.NewDecoder(resp.Body).Decode(&embResp))
+	assert.Equal("text-embedding-small", embResp.Model)
+	if assert.Len(embResp.Data, 1) {
+		assert.Equal([]interface{}{0.1, 0.2, 0.3}, embResp.Data[0].Embedding)
+	}
+
+	// Embedding-only models cannot serve completions
+	enc, err = json.Marshal(message.CompletionsRequest{Model: "text-embedding-small", Prompt: "Hello,"})
+	assert.NoError(err)
+	resp, err = http.Post(hubUrl.JoinPath("/v1/completions").String(), "application/json", bytes.NewReader(enc))
+	assert.NoError(err)
+	assert.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+
+	// Cancel the context and wait for everything to shut down
+	cancel()
+	wg.Wait()
+}
+
+func TestAnthropicMessages(t *testing.T) {
+	assert := assert.New(t)
+	wg := &sync.WaitGroup{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hubListen := "127.22.33.61:9090"
+	inferenceListen := "127.22.33.61:5000"
+	hubUrl := url.URL{Scheme: "http", Host: hubListen}
+
+	// Write the config file
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	assert.NoError(os.WriteFile(configFile, []byte(`{
+		"api_keys": [{"key": "sk-test", "name": "test"}]
+	}`), 0o600))
+
+	// Start the inference server
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		dummyInferenceServer(inferenceListen, ctx)
+	}()
+
+	// Start the server
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		hub.RunServer(&hub.ServerOpts{Addr: hubListen, ConfigFile: configFile}, ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// Start an agent
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		agent.RunAgent(&agent.AgentOpts{
+			HubAddr:    url.URL{Scheme: "ws", Host: hubListen},
+			Inference:  []agent.InferenceBackend{{Addr: url.URL{Scheme: "http", Host: inferenceListen}}},
+			WorkerName: "test-worker",
+		}, ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	send := func(apiKey string, model string, stream bool) *http.Response {
+		enc, err := json.Marshal(message.AnthropicMessagesRequest{
+			Model:     model,
+			System:    "You are a helpful assistant.",
+			MaxTokens: 64,
+			Messages: []message.AnthropicMessage{
+				{Role: "user", Content: []map[string]string{{"type": "text", "text": "Hello!"}}},
+			},
+			Stream: stream,
+		})
+		assert.NoError(err)
+		req, err := http.NewRequest("POST", hubUrl.JoinPath("/v1/messages").String(), bytes.NewReader(enc))
+		assert.NoError(err)
+		req.Header.Set("X-Api-Key", apiKey)
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(err)
+		return resp
+	}
+
+	// Non-streaming requests return a single message
+	resp := send("sk-test", "gpt-2", false)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	var msg message.AnthropicMessagesResponse
+	assert.NoError(json.NewDecoder(resp.Body).Decode(&msg))
+	assert.Equal("message", msg.Type)
+	assert.Equal("assistant", msg.Role)
+	assert.Equal([]message.AnthropicContentBlock{{Type: "text", Text: "Hi there!"}}, msg.Content)
+	if assert.NotNil(msg.StopReason) {
+		assert.Equal("end_turn", *msg.StopReason)
+	}
+
+	// Streaming requests are translated into typed events
+	resp = send("sk-test", "gpt-2", true)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal("text/event-stream", resp.Header.Get("Content-Type"))
+	scanner := bufio.NewScanner(resp.Body)
+	events := []string{}
+	text := ""
+	for scanner.Scan() {
+		line, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var event struct {
+			Type  string `json:"type"`
+			Delta struct {
+				Text       string `json:"text"`
+				StopReason string `json:"stop_reason"`
+			} `json:"delta"`
+		}
+		assert.NoError(json.Unmarshal([]byte(line), &event))
+		events = append(events, event.Type)
+		switch event.Type {
+		case "content_block_delta":
+			text += event.Delta.Text
+		case "message_delta":
+			assert.Equal("end_turn", event.Delta.StopReason)
+		}
+	}
+	assert.Equal([]string{
+		"message_start", "content_block_start",
+		"content_block_delta", "content_block_delta", "content_block_delta",
+		"content_block_stop", "message_delta", "message_stop",
+	}, events)
+	assert.Equal("Hi there!", text)
+
+	// Errors use the Anthropic format
+	for _, tc := range []struct {
+		apiKey string
+		model  string
+		status int
+		typ    string
+	}{
+		{"sk-wrong", "gpt-2", http.StatusUnauthorized, "authentication_error"},
+		{"sk-test", "unknown", http.StatusServiceUnavailable, "overloaded_error"},
+	} {
+		resp = send(tc.apiKey, tc.model, true)
+		assert.Equal(tc.status, resp.StatusCode)
+		var errResp message.AnthropicErrorResponse
+		assert.NoError(json.NewDecoder(resp.Body).Decode(&errResp))
+		assert.Equal("error", errResp.Type)
+		assert.Equal(tc.typ, errResp.Error.Type)
+	}
+
+	// Cancel the context and wait for everything to shut down
+	cancel()
+	wg.Wait()
+}
+
+func TestOllama(t *testing.T) {
+	assert := assert.New(t)
+	wg := &sync.WaitGroup{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hubListen := "127.22.33.62:9090"
+	inferenceListen := "127.22.33.62:5000"
+	hubUrl := url.URL{Scheme: "http", Host: hubListen}
+
+	// Write the config file
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	assert.NoError(os.WriteFile(configFile, []byte(`{
+		"aliases": [{"alias": "llama", "models": ["gpt-*"]}],
+		"api_keys": [{"key": "sk-test", "name": "test"}]
+	}`), 0o600))
+
+	// Start the inference server
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		dummyInferenceServer(inferenceListen, ctx)
+	}()
+
+	// Start the server
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		hub.RunServer(&hub.ServerOpts{Addr: hubListen, ConfigFile: configFile}, ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// Start an agent
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		agent.RunAgent(&agent.AgentOpts{
+			HubAddr:    url.URL{Scheme: "ws", Host: hubListen},
+			Inference:  []agent.InferenceBackend{{Addr: url.URL{Scheme: "http", Host: inferenceListen}}},
+			WorkerName: "test-worker",
+		}, ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// Authentication failures use the Ollama format
+	resp, err := http.Get(hubUrl.JoinPath("/api/tags").String())
+	assert.NoError(err)
+	assert.Equal(http.StatusUnauthorized, resp.StatusCode)
+	var errResp message.OllamaErrorResponse
+	assert.NoError(json.NewDecoder(resp.Body).Decode(&errResp))
+	assert.Contains(errResp.Error, "didn't provide an API key")
+
+	// Models and aliases should be listed as tags
+	req, err := http.NewRequest("GET", hubUrl.JoinPath("/api/tags").String(), nil)
+	assert.NoError(err)
+	req.Header.Set("Authorization", "Bearer sk-test")
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(err)
+	var tags message.OllamaTagsResponse
+	assert.NoError(json.NewDecoder(resp.Body).Decode(&tags))
+	names := make([]string, 0)
+	for _, model := range tags.Models {
+		names = append(names, model.Name)
+	}
+	assert.ElementsMatch([]string{"gpt-2", "llama"}, names)
+
+	post := func(path string, body any) *http.Response {
+		enc, err := json.Marshal(body)
+		assert.NoError(err)
+		req, err := http.NewRequest("POST", hubUrl.JoinPath(path).String(), bytes.NewReader(enc))
+		assert.NoError(err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer sk-test")
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(err)
+		return resp
+	}
+	noStream := false
+
+	// Generate requests stream by default, as newline-delimited JSON
+	resp = post("/api/generate", message.OllamaGenerateRequest{Model: "gpt-2", Prompt: "Hello!"})
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal("application/x-ndjson", resp.Header.Get("Content-Type"))
+	scanner := bufio.NewScanner(resp.Body)
+	text := ""
+	var last message.OllamaGenerateResponse
+	for scanner.Scan() {
+		last = message.OllamaGenerateResponse{}
+		assert.NoError(json.Unmarshal(scanner.Bytes(), &last))
+		assert.Equal("gpt-2", last.Model)
+		text += last.Response
+	}
+	assert.Equal("Hi there!", text)
+	assert.True(last.Done)
+	assert.Equal("stop", last.DoneReason)
+
+	// Raw prompts are sent as completions
+	resp = post("/api/generate", message.OllamaGenerateRequest{Model: "gpt-2", Prompt: "Hello,", Raw: true, Stream: &noStream})
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	var genResp message.OllamaGenerateResponse
+	assert.NoError(json.NewDecoder(resp.Body).Decode(&genResp))
+	assert.Equal("Hello, world!", genResp.Response)
+	assert.True(genResp.Done)
+	assert.Equal("length", genResp.DoneReason)
+
+	// Chat requests return a message
+	resp = post("/api/chat", message.OllamaChatRequest{
+		Model:    "gpt-2",
+		Messages: []message.OllamaMessage{{Role: "user", Content: "Hello!"}},
+		Stream:   &noStream,
+	})
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	var chatResp message.OllamaChatResponse
+	assert.NoError(json.NewDecoder(resp.Body).Decode(&chatResp))
+	assert.Equal(message.OllamaMessage{Role: "assistant", Content: "Hi there!"}, chatResp.Message)
+	assert.True(chatResp.Done)
+
+	// Errors use the Ollama format
+	resp = post("/api/chat", message.OllamaChatRequest{Model: "unknown"})
+	assert.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+	errResp = message.OllamaErrorResponse{}
+	assert.NoError(json.NewDecoder(resp.Body).Decode(&errResp))
+	assert.Equal("No workers available for model", errResp.Error)
+
+	// Cancel the context and wait for everything to shut down
+	cancel()
+	wg.Wait()
+}
+
+// nativeInferenceServer serves the native APIs of llama.cpp, TGI and Ollama,
+// each with its own model, streaming "Hello from <backend>" token by token.
+func nativeInferenceServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	tokens := func(backend string) []string {
+		return []string{"Hello", " from", " " + backend}
+	}
+	stream := func(w http.ResponseWriter, prefix string, chunks []any) {
+		w.WriteHeader(http.StatusOK)
+		for _, chunk := range chunks {
+			enc, _ := json.Marshal(chunk)
+			fmt.Fprintf(w, "%s%s\n", prefix, enc)
+			if prefix != "" {
+				w.Write([]byte("\n"))
+			}
+			w.(http.Flusher).Flush()
+		}
+	}
+
+	// llama.cpp
+	mux.HandleFunc("/props", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"model_path": "/models/llama-native.gguf", "total_slots": 2})
+	})
+	mux.HandleFunc("/completion", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Stream bool `json:"stream"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if !req.Stream {
+			json.NewEncoder(w).Encode(map[string]any{
+				"content": "Hello from llama.cpp", "stop": true, "stopped_limit": true, "tokens_predicted": 3,
+			})
+			return
+		}
+		chunks := []any{}
+		for _, token := range tokens("llama.cpp") {
+			chunks = append(chunks, map[string]any{"content": token, "stop": false})
+		}
+		chunks = append(chunks, map[string]any{"content": "", "stop": true, "stopped_limit": true, "tokens_predicted": 3})
+		stream(w, "data: ", chunks)
+	})
+
+	// TGI
+	mux.HandleFunc("/info", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"model_id": "tgi-native", "max_concurrent_requests": 8})
+	})
+	mux.HandleFunc("/generate", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"generated_text": "Hello from TGI",
+			"details":        map[string]any{"finish_reason": "length", "generated_tokens": 3},
+		})
+	})
+	mux.HandleFunc("/generate_stream", func(w http.ResponseWriter, r *http.Request) {
+		chunks := []any{}
+		for i, token := range tokens("TGI") {
+			chunk := map[string]any{"token": map[string]any{"text": token}, "generated_text": nil, "details": nil}
+			if i == 2 {
+				chunk["generated_text"] = "Hello from TGI"
+				chunk["details"] = map[string]any{"finish_reason": "length", "generated_tokens": 3}
+			}
+			chunks = append(chunks, chunk)
+		}
+		stream(w, "data:", chunks)
+	})
+
+	// Ollama
+	mux.HandleFunc("/api/tags", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(message.OllamaTagsResponse{Models: []message.OllamaModel{{Name: "ollama-native"}}})
+	})
+	ollama := func(chat bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			var req struct {
+				Stream *bool `json:"stream"`
+			}
+			json.NewDecoder(r.Body).Decode(&req)
+			chunk := func(text string, done bool) any {
+				resp := map[string]any{"done": done}
+				if chat {
+					resp["message"] = map[string]any{"role": "assistant", "content": text}
+				} else {
+					resp["response"] = text
+				}
+				if done {
+					resp["done_reason"] = "length"
+					resp["eval_count"] = 3
+				}
+				return resp
+			}
+			if req.Stream != nil && !*req.Stream {
+				json.NewEncoder(w).Encode(chunk("Hello from Ollama", true))
+				return
+			}
+			chunks := []any{}
+			for _, token := range tokens("Ollama") {
+				chunks = append(chunks, chunk(token, false))
+			}
+			chunks = append(chunks, chunk("", true))
+			stream(w, "", chunks)
+		}
+	}
+	mux.HandleFunc("/api/generate", ollama(false))
+	mux.HandleFunc("/api/chat", ollama(true))
+
+	server := &http.Server{Addr: addr, Handler: mux}
+	go server.ListenAndServe()
+	return server
+}
+
+func TestBackendTypes(t *testing.T) {
+	assert := assert.New(t)
+	wg := &sync.WaitGroup{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hubListen := "127.22.33.63:9090"
+	inferenceListen := "127.22.33.63:5000"
+	hubUrl := url.URL{Scheme: "http", Host: hubListen}
+
+	// Start the inference server
+	server := nativeInferenceServer(inferenceListen)
+	defer server.Close()
+
+	// Start the server
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		hub.RunServer(&hub.ServerOpts{Addr: hubListen}, ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// Start an agent for each backend type
+	for _, backendType := range []string{"llamacpp", "tgi", "ollama"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			agent.RunAgent(&agent.AgentOpts{
+				HubAddr:     url.URL{Scheme: "ws", Host: hubListen},
+				Inference:   []agent.InferenceBackend{{Addr: url.URL{Scheme: "http", Host: inferenceListen}}},
+				BackendType: backendType,
+				WorkerName:  backendType + "-worker",
+			}, ctx)
+		}()
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	// Each backend should announce its model
+	resp, err := http.Get(hubUrl.JoinPath("/v1/models").String())
+	assert.NoError(err)
+	var models message.ListModelsResponse
+	assert.NoError(json.NewDecoder(resp.Body).Decode(&models))
+	ids := []string{}
+	for _, model := range models.Data {
+		ids = append(ids, model.Id)
+	}
+	assert.ElementsMatch([]string{"llama-native", "tgi-native", "ollama-native"}, ids)
+
+	post := func(path string, req any) *http.Response {
+		enc, err := json.Marshal(req)
+		assert.NoError(err)
+		resp, err := http.Post(hubUrl.JoinPath(path).String(), "application/json", bytes.NewReader(enc))
+		assert.NoError(err)
+		assert.Equal(http.StatusOK, resp.StatusCode)
+		return resp
+	}
+
+	// Native responses are translated into OpenAI completions
+	for model, backend := range map[string]string{
+		"llama-native":  "llama.cpp",
+		"tgi-native":    "TGI",
+		"ollama-native": "Ollama",
+	} {
+		resp = post("/v1/completions", message.CompletionsRequest{Model: model, Prompt: "Hi"})
+		var compResp message.CompletionsResponse
+		assert.NoError(json.NewDecoder(resp.Body).Decode(&compResp))
+		if assert.Len(compResp.Choices, 1) {
+			assert.Equal("Hello from "+backend, compResp.Choices[0].Text)
+			assert.Equal("length", *compResp.Choices[0].FinishReason)
+		}
+		assert.Equal(model, compResp.Model)
+
+		resp = post("/v1/completions", message.CompletionsRequest{Model: model, Prompt: "Hi", Stream: true})
+		scanner := bufio.NewScanner(resp.Body)
+		text := ""
+		finishReason := ""
+		for scanner.Scan() {
+			line, ok := strings.CutPrefix(scanner.Text(), "data: ")
+			if !ok {
+				continue
+			}
+			var chunk message.CompletionsResponse
+			assert.NoError(json.Unmarshal([]byte(line), &chunk))
+			text += chunk.Choices[0].Text
+			if chunk.Choices[0].FinishReason != nil {
+				finishReason = *chunk.Choices[0].FinishReason
+			}
+		}
+		assert.Equal("Hello from "+backend, text)
+		assert.Equal("length", finishReason)
+	}
+
+	// Chat completions are served natively by Ollama
+	resp = post("/v1/chat/completions", message.ChatCompletionsRequest{
+		Model:    "ollama-native",
+		Messages: []message.ChatMessage{{Role: "user", Content: "Hi"}},
+		Stream:   true,
+	})
+	scanner := bufio.NewScanner(resp.Body)
+	text := ""
+	for scanner.Scan() {
+		line, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var chunk message.ChatCompletionsResponse
+		assert.NoError(json.Unmarshal([]byte(line), &chunk))
+		assert.Equal("chat.completion.chunk", chunk.Object)
+		content, _ := chunk.Choices[0].Delta.Content.(string)
+		text += content
+	}
+	assert.Equal("Hello from Ollama", text)
+
+	// Cancel the context and wait for everything to shut down
+	cancel()
+	wg.Wait()
+}
+
+func TestMultipleBackends(t *testing.T) {
+	assert := assert.New(t)
+	wg := &sync.WaitGroup{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hubListen := "127.22.33.64:9090"
+	nativeListen := "127.22.33.64:5002"
+	hubUrl := url.URL{Scheme: "http", Host: hubListen}
+
+	// Start two identical inference servers, counting the completions
+	// requests each of them receives and the most it has in progress at once
+	counts := []int{0, 0}
+	active := []int{0, 0}
+	peaks := []int{0, 0}
+	delay := time.Duration(0)
+	countsLock := sync.Mutex{}
+	for i := range 2 {
+		inferenceListen := fmt.Sprintf("127.22.33.64:%d", 5000+i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dummyInferenceServer(inferenceListen, ctx)
+		}()
+
+		proxy := &http.Server{
+			Addr: fmt.Sprintf("127.22.33.64:%d", 5010+i),
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/v1/completions" {
+					countsLock.Lock()
+					counts[i]++
+					active[i]++
+					peaks[i] = max(peaks[i], active[i])
+					wait := delay
+					countsLock.Unlock()
+
+					time.Sleep(wait)
+					defer func() {
+						countsLock.Lock()
+						active[i]--
+						countsLock.Unlock()
+					}()
+				}
+				httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: inferenceListen}).ServeHTTP(w, r)
+			}),
+		}
+		go proxy.ListenAndServe()
+		defer proxy.Close()
+	}
+	native := nativeInferenceServer(nativeListen)
+	defer native.Close()
+
+	// Start the server
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		hub.RunServer(&hub.ServerOpts{Addr: hubListen}, ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// Start a single agent for all the inference servers. The llama.cpp
+	// model is filtered out.
+	backends := []agent.InferenceBackend{}
+	for _, spec := range []string{
+		"http://127.22.33.64:5010",
+		"http://127.22.33.64:5011;models=gpt-*",
+		"http://" + nativeListen + ";type=tgi;auth=Bearer tgi",
+		"http://" + nativeListen + ";type=llamacpp;models=other-*",
+	} {
+		var backend agent.InferenceBackend
+		assert.NoError(backend.UnmarshalText([]byte(spec)))
+		backends = append(backends, backend)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		agent.RunAgent(&agent.AgentOpts{
+			HubAddr:    url.URL{Scheme: "ws", Host: hubListen},
+			Inference:  backends,
+			WorkerName: "multi-worker",
+		}, ctx)
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	// The worker should announce the models and slots of all the servers
+	resp, err := http.Get(hubUrl.JoinPath("/internal/v1/workers").String())
+	assert.NoError(err)
+	var workers []hub.Worker
+	assert.NoError(json.NewDecoder(resp.Body).Decode(&workers))
+	if assert.Len(workers, 1) {
+		ids := []string{}
+		for _, model := range workers[0].Info.AvailableModels {
+			ids = append(ids, model.Id)
+		}
+		assert.ElementsMatch([]string{"gpt-2", "tgi-native"}, ids)
+		assert.Equal(4+4+8, workers[0].Info.MaxConcurrency)
+	}
+
+	complete := func(model string) *http.Response {
+		enc, err := json.Marshal(message.CompletionsRequest{Model: model, Prompt: "Hi"})
+		assert.NoError(err)
+		resp, err := http.Post(hubUrl.JoinPath("/v1/completions").String(), "application/json", bytes.NewReader(enc))
+		assert.NoError(err)
+		return resp
+	}
+
+	// Requests are spread over the servers of the model
+	for range 10 {
+		resp = complete("gpt-2")
+		assert.Equal(http.StatusOK, resp.StatusCode)
+		resp.Body.Close()
+	}
+	countsLock.Lock()
+	assert.Equal([]int{5, 5}, counts)
+	countsLock.Unlock()
+
+	// The hub counts the slots of the TGI server too, but no server of the
+	// model is sent more requests than it has slots
+	countsLock.Lock()
+	delay = 100 * time.Millisecond
+	countsLock.Unlock()
+	requests := sync.WaitGroup{}
+	for range 12 {
+		requests.Add(1)
+		go func() {
+			defer requests.Done()
+			resp := complete("gpt-2")
+			assert.Equal(http.StatusOK, resp.StatusCode)
+			resp.Body.Close()
+		}()
+	}
+	requests.Wait()
+	countsLock.Lock()
+	assert.Equal(22, counts[0]+counts[1])
+	assert.LessOrEqual(peaks[0], 4)
+	assert.LessOrEqual(peaks[1], 4)
+	countsLock.Unlock()
+
+	// Each request goes to the server of its model
+	resp = complete("tgi-native")
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	var compResp message.CompletionsResponse
+	assert.NoError(json.NewDecoder(resp.Body).Decode(&compResp))
+	if assert.Len(compResp.Choices, 1) {
+		assert.Equal("Hello from TGI", compResp.Choices[0].Text)
+	}
+
+	// Cancel the context and wait for everything to shut down
+	cancel()
+	wg.Wait()
+}
+
+// adminWorker is the view of a worker returned by the admin API.
+type adminWorker struct {
+	Name           string `json:"name"`
+	MaxConcurrency int    `json:"max_concurrency"`
+	ActiveTasks    int    `json:"active_tasks"`
+	TotalRequests  int    `json:"total_requests"`
+}
+
+// adminWorkers lists the workers connected to the hub through the admin API,
+// by name.
+func adminWorkers(hubUrl url.URL, token string) (map[string]adminWorker, error) {
+	req, err := http.NewRequest("GET", hubUrl.JoinPath("/admin/v1/workers").String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var list []adminWorker
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+	workers := make(map[string]adminWorker, len(list))
+	for _, w := range list {
+		workers[w.Name] = w
+	}
+	return workers, nil
+}
+
+func TestCancel(t *testing.T) {
+	assert := assert.New(t)
+	wg := &sync.WaitGroup{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hubListen := "127.22.33.65:9090"
+	inferenceListen := "127.22.33.65:5000"
+	hubUrl := url.URL{Scheme: "http", Host: hubListen}
+
+	// Start an inference server that streams a single chunk, then waits for
+	// its request to be cancelled
+	cancelled := make(chan struct{}, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/models", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(message.ListModelsResponse{
+			Object: "list",
+			Data:   []message.Model{{Id: "gpt-2", Object: "model", OwnedBy: "openai"}},
+		})
+	})
+	mux.HandleFunc("/v1/completions", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("data: "))
+		json.NewEncoder(w).Encode(message.CompletionsResponse{
+			ID:      "cmpl-0000",
+			Object:  "text_completion",
+			Model:   "gpt-2",
+			Choices: []message.CompletionsChoice{{Text: "lmrouter"}},
+		})
+		w.Write([]byte("\n"))
+		w.(http.Flusher).Flush()
+
+		select {
+		case <-r.Context().Done():
+			cancelled <- struct{}{}
+		case <-time.After(10 * time.Second):
+		}
+	})
+	server := &http.Server{Addr: inferenceListen, Handler: mux}
+	go server.ListenAndServe()
+	defer server.Close()
+
+	// Start the server
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		hub.RunServer(&hub.ServerOpts{Addr: hubListen, AdminTokens: []string{"admin-secret"}}, ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// Start the agent
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		agent.RunAgent(&agent.AgentOpts{
+			HubAddr:    url.URL{Scheme: "ws", Host: hubListen},
+			Inference:  []agent.InferenceBackend{{Addr: url.URL{Scheme: "http", Host: inferenceListen}}},
+			WorkerName: "test-worker",
+		}, ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// Start a stream and read its first chunk
+	enc, err := json.Marshal(message.CompletionsRequest{Model: "gpt-2", Prompt: "Hello,", Stream: true})
+	assert.NoError(err)
+	resp, err := http.Post(hubUrl.JoinPath("/v1/completions").String(), "application/json", bytes.NewReader(enc))
+	assert.NoError(err)
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	assert.NoError(err)
+	assert.Contains(line, "lmrouter")
+	workers, err := adminWorkers(hubUrl, "admin-secret")
+	assert.NoError(err)
+	assert.Equal(1, workers["test-worker"].ActiveTasks)
+
+	// Drop the client, the request to the inference server should be
+	// cancelled and the worker slot freed
+	resp.Body.Close()
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		assert.Fail("inference server request was not cancelled")
+	}
+	assert.Eventually(func() bool {
+		workers, err := adminWorkers(hubUrl, "admin-secret")
+		return err == nil && workers["test-worker"].ActiveTasks == 0
+	}, time.Second, 20*time.Millisecond)
+
+	// Cancel the context and wait for everything to shut down
+	cancel()
+	wg.Wait()
+}
+
+func TestRateLimits(t *testing.T) {
+	assert := assert.New(t)
+	wg := &sync.WaitGroup{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hubListen := "127.22.33.66:9090"
+	inferenceListen := "127.22.33.66:5000"
+	hubUrl := url.URL{Scheme: "http", Host: hubListen}
+
+	// Write the config file, limiting each client IP as given by the proxy
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	assert.NoError(os.WriteFile(configFile, []byte(`{
+		"rate_limit": {"max_concurrent": 1, "tokens_per_minute": 5},
+		"trust_proxy": true
+	}`), 0o600))
+
+	// Start the inference server
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		dummyInferenceServer(inferenceListen, ctx)
+	}()
+
+	// Start the server
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		hub.RunServer(&hub.ServerOpts{Addr: hubListen, ConfigFile: configFile}, ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// Start an agent
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		agent.RunAgent(&agent.AgentOpts{
+			HubAddr:    url.URL{Scheme: "ws", Host: hubListen},
+			Inference:  []agent.InferenceBackend{{Addr: url.URL{Scheme: "http", Host: inferenceListen}}},
+			WorkerName: "test-worker",
+		}, ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	complete := func(ip string, stream bool) *http.Response {
+		enc, err := json.Marshal(message.CompletionsRequest{Model: "gpt-2", Prompt: "Hello,", Stream: stream})
+		assert.NoError(err)
+		req, err := http.NewRequest("POST", hubUrl.JoinPath("/v1/completions").String(), bytes.NewReader(enc))
+		assert.NoError(err)
+		req.Header.Set("X-Forwarded-For", ip+", 10.0.0.254")
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(err)
+		return resp
+	}
+	assertLimited := func(resp *http.Response, exceeded string) {
+		defer resp.Body.Close()
+		assert.Equal(http.StatusTooManyRequests, resp.StatusCode)
+		assert.NotEmpty(resp.Header.Get("Retry-After"))
+		var errResp message.ErrorResponse
+		assert.NoError(json.NewDecoder(resp.Body).Decode(&errResp))
+		assert.Contains(errResp.Error.Message, exceeded)
+	}
+
+	// Start a stream, a second request from the same client should be turned
+	// away while it is in progress
+	stream := complete("10.0.0.1", true)
+	assert.Equal(http.StatusOK, stream.StatusCode)
+	reader := bufio.NewReader(stream.Body)
+	_, err := reader.ReadString('\n')
+	assert.NoError(err)
+	assertLimited(complete("10.0.0.1", false), "concurrent requests")
+
+	// Other clients are limited separately
+	resp := complete("10.0.0.2", false)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	resp.Body.Close()
+
+	// The stream uses more tokens than allowed per minute, so the client
+	// has to wait once it completes
+	_, err = io.ReadAll(reader)
+	assert.NoError(err)
+	stream.Body.Close()
+	assertLimited(complete("10.0.0.1", false), "tokens per minute")
+
+	// The other client still has tokens left
+	resp = complete("10.0.0.2", false)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	resp.Body.Close()
+
+	// Cancel the context and wait for everything to shut down
+	cancel()
+	wg.Wait()
+}
+
+func TestSlotScheduling(t *testing.T) {
+	assert := assert.New(t)
+	wg := &sync.WaitGroup{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hubListen := "127.22.33.67:9090"
+	inferenceListen := "127.22.33.67:5000"
+	hubUrl := url.URL{Scheme: "http", Host: hubListen}
+
+	// Start an inference server whose streams are held until released
+	hold := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/models", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(message.ListModelsResponse{
+			Object: "list",
+			Data:   []message.Model{{Id: "gpt-2", Object: "model", OwnedBy: "openai"}},
+		})
+	})
+	mux.HandleFunc("/v1/completions", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("data: "))
+		json.NewEncoder(w).Encode(message.CompletionsResponse{
+			ID:      "cmpl-0000",
+			Object:  "text_completion",
+			Model:   "gpt-2",
+			Choices: []message.CompletionsChoice{{Text: "lmrouter"}},
+		})
+		w.Write([]byte("\n"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-hold:
+		case <-r.Context().Done():
+		}
+	})
+	server := &http.Server{Addr: inferenceListen, Handler: mux}
+	go server.ListenAndServe()
+	defer server.Close()
+
+	// Start the server
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		hub.RunServer(&hub.ServerOpts{
+			Addr:         hubListen,
+			AdminTokens:  []string{"admin-secret"},
+			QueueTimeout: 2 * time.Second,
+		}, ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// Start two agents with a different number of slots
+	for name, slots := range map[string]int{"small-worker": 2, "large-worker": 6} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			agent.RunAgent(&agent.AgentOpts{
+				HubAddr:        url.URL{Scheme: "ws", Host: hubListen},
+				Inference:      []agent.InferenceBackend{{Addr: url.URL{Scheme: "http", Host: inferenceListen}}},
+				WorkerName:     name,
+				MaxConcurrency: slots,
+			}, ctx)
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	enc, err := json.Marshal(message.CompletionsRequest{Model: "gpt-2", Prompt: "Hello,", Stream: true})
+	assert.NoError(err)
+	startStream := func() {
+		resp, err := http.Post(hubUrl.JoinPath("/v1/completions").String(), "application/json", bytes.NewReader(enc))
+		assert.NoError(err)
+		assert.Equal(http.StatusOK, resp.StatusCode)
+		_, err = bufio.NewReader(resp.Body).ReadString('\n')
+		assert.NoError(err)
+		t.Cleanup(func() { resp.Body.Close() })
+	}
+	activeTasks := func() map[string]int {
+		workers, err := adminWorkers(hubUrl, "admin-secret")
+		assert.NoError(err)
+		active := map[string]int{}
+		for name, w := range workers {
+			active[name] = w.ActiveTasks
+		}
+		return active
+	}
+
+	// Requests go to the worker with the largest share of free slots rather
+	// than the fewest requests
+	for range 4 {
+		startStream()
+	}
+	assert.Equal(map[string]int{"small-worker": 1, "large-worker": 3}, activeTasks())
+
+	// Fill up both workers
+	for range 4 {
+		startStream()
+	}
+	assert.Equal(map[string]int{"small-worker": 2, "large-worker": 6}, activeTasks())
+
+	// Another request has to wait, as no worker may exceed its slots
+	queued := make(chan *http.Response)
+	go func() {
+		resp, err := http.Post(hubUrl.JoinPath("/v1/completions").String(), "application/json", bytes.NewReader(enc))
+		assert.NoError(err)
+		queued <- resp
+	}()
+	select {
+	case resp := <-queued:
+		resp.Body.Close()
+		assert.Fail("request was served while all workers were full")
+	case <-time.After(200 * time.Millisecond):
+	}
+	assert.Equal(map[string]int{"small-worker": 2, "large-worker": 6}, activeTasks())
+
+	// Once the streams complete, the waiting request should be served
+	close(hold)
+	select {
+	case resp := <-queued:
+		assert.Equal(http.StatusOK, resp.StatusCode)
+		resp.Body.Close()
+	case <-time.After(time.Second):
+		assert.Fail("queued request was not served")
+	}
+
+	// Cancel the context and wait for everything to shut down
+	cancel()
+	wg.Wait()
+}
+
+func TestHubSignalDrain(t *testing.T) {
+	assert := assert.New(t)
+	wg := &sync.WaitGroup{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hubListen := "127.22.33.68:9090"
+	inferenceListen := "127.22.33.68:5000"
+	hubUrl := url.URL{Scheme: "http", Host: hubListen}
+
+	// Build the binary, the signals it handles are set up in main
+	bin := filepath.Join(t.TempDir(), "lmrouter")
+	out, err := exec.Command("go", "build", "-o", bin, "github.com/hizkifw/lmrouter").CombinedOutput()
+	if !assert.NoError(err, string(out)) {
+		return
+	}
+
+	// Start an inference server whose streams are held until released
+	hold := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/models", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(message.ListModelsResponse{
+			Object: "list",
+			Data:   []message.Model{{Id: "gpt-2", Object: "model", OwnedBy: "openai"}},
+		})
+	})
+	mux.HandleFunc("/v1/completions", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("data: "))
+		json.NewEncoder(w).Encode(message.CompletionsResponse{
+			ID:      "cmpl-0000",
+			Object:  "text_completion",
+			Model:   "gpt-2",
+			Choices: []message.CompletionsChoice{{Text: "lmrouter"}},
+		})
+		w.Write([]byte("\n"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-hold:
+		case <-r.Context().Done():
+		}
+	})
+	server := &http.Server{Addr: inferenceListen, Handler: mux}
+	go server.ListenAndServe()
+	defer server.Close()
+
+	// Start the hub as its own process
+	cmd := exec.Command(bin, "server", "--listen", hubListen, "--shutdown-timeout", "5s")
+	if !assert.NoError(cmd.Start()) {
+		return
+	}
+	defer cmd.Process.Kill()
+	assert.Eventually(func() bool {
+		resp, err := http.Get(hubUrl.JoinPath("/v1/models").String())
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return true
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// Start the agent
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		agent.RunAgent(&agent.AgentOpts{
+			HubAddr:    url.URL{Scheme: "ws", Host: hubListen},
+			Inference:  []agent.InferenceBackend{{Addr: url.URL{Scheme: "http", Host: inferenceListen}}},
+			WorkerName: "test-worker",
+		}, ctx)
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	// Start a stream, then stop the hub the way a service manager would
+	enc, err := json.Marshal(message.CompletionsRequest{Model: "gpt-2", Prompt: "Hello,", Stream: true})
+	assert.NoError(err)
+	resp, err := http.Post(hubUrl.JoinPath("/v1/completions").String(), "application/json", bytes.NewReader(enc))
+	if !assert.NoError(err) {
+		return
+	}
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+	_, err = reader.ReadString('\n')
+	assert.NoError(err)
+	assert.NoError(cmd.Process.Signal(syscall.SIGTERM))
+
+	// New requests should be turned away while the stream is in progress
+	assert.Eventually(func() bool {
+		rejected, err := http.Post(hubUrl.JoinPath("/v1/completions").String(), "application/json", bytes.NewReader(enc))
+		if err != nil {
+			return false
+		}
+		rejected.Body.Close()
+		return rejected.StatusCode == http.StatusServiceUnavailable
+	}, 2*time.Second, 20*time.Millisecond)
+
+	// The stream should complete normally, then the hub should exit
+	close(hold)
+	rest, err := io.ReadAll(reader)
+	assert.NoError(err)
+	assert.NotContains(string(rest), "event: error")
+	exited := make(chan error)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	select {
+	case err := <-exited:
+		assert.NoError(err)
+	case <-time.After(5 * time.Second):
+		assert.Fail("hub did not exit after draining")
+	}
+
+	// Cancel the context and wait for everything to shut down
+	cancel()
+	wg.Wait()
+}